@@ -17,21 +17,30 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	uberzap "go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/flowcontrol"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/yaml"
 
 	"loxilb.io/loxilb-ingress-manager/managers"
 	"loxilb.io/loxilb-ingress-manager/pkg"
@@ -54,10 +63,117 @@ func init() {
 
 func main() {
 	var loxilbIngressIP string
+	var loxilbIngressIPv6 string
+	var ruleNamePrefix string
 	var enableLeaderElection bool
 	var probeAddr string
+	var pprofAddr string
+	var namespaceSelector string
+	var clusterDomain string
+	var dnsResyncPeriod time.Duration
+	var initialSyncTimeout time.Duration
+	var migrateBackendAnnotations bool
+	var loxiQPS float64
+	var loxiBurst int
+	var cleanupOnShutdown bool
+	var nginxCompat bool
+	var nodeName string
+	var finalizer string
+	var requireOptIn bool
+	var skipStatusUpdate bool
+	var exportIngresses bool
+	var validateFile string
+	var ingressClassController string
+	var healthWindow time.Duration
+	var healthThreshold float64
+	var maxRules int
+	var maxEndpoints int
+	var maxRuleEndpoints int
+	var backendDebounce time.Duration
+	var retryBudget float64
+	var breakerThreshold int
+	var fullResyncPeriod time.Duration
+	var breakerCooldown time.Duration
+	var deletionGracePeriod time.Duration
+	var enableLogLevelEndpoint bool
 	flag.StringVar(&loxilbIngressIP, "pod-ip", "127.0.0.1", "The address LoxiLB ingress pod's self IP address.")
+	flag.StringVar(&loxilbIngressIPv6, "pod-ipv6", "",
+		"The IPv6 address of the LoxiLB ingress pod, for Ingresses annotated with loxilb.io/ip-family ipv6 or dual.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&pprofAddr, "pprof-bind-address", "",
+		"The address the pprof endpoint binds to (debug only). "+
+			"Leave empty to disable it; prefer a localhost address such as 127.0.0.1:6060 when enabled.")
+	flag.StringVar(&namespaceSelector, "namespace-selector", "",
+		"Label selector of the namespaces whose Ingresses are programmed. Empty selects all namespaces.")
+	flag.StringVar(&clusterDomain, "cluster-domain", "cluster.local", "The DNS domain of the cluster.")
+	flag.DurationVar(&dnsResyncPeriod, "dns-resync-period", 30*time.Second,
+		"How often backends using DNS endpoint discovery are re-resolved.")
+	flag.DurationVar(&fullResyncPeriod, "full-resync-period", 5*time.Minute,
+		"How often every Ingress is reprogrammed in full even when nothing changed, repairing loxilb rules lost "+
+			"or changed out of band, e.g. by a loxilb restart. 0 only reprograms on changes.")
+	flag.DurationVar(&initialSyncTimeout, "initial-sync-timeout", 2*time.Minute,
+		"How long to wait for existing Ingresses to be reprogrammed at startup before reporting ready.")
+	flag.BoolVar(&migrateBackendAnnotations, "migrate-backend-annotations", false,
+		"Rewrite Ingresses using the deprecated external-backend-service annotations "+
+			"to loxilb.io/backend-namespaces once at startup.")
+	flag.Float64Var(&loxiQPS, "loxilb-qps", 20, "Maximum rate of loxilb API calls per second. 0 disables the limit.")
+	flag.IntVar(&loxiBurst, "loxilb-burst", 50, "Maximum burst of loxilb API calls.")
+	flag.BoolVar(&cleanupOnShutdown, "cleanup-on-shutdown", false,
+		"Delete all loxilb rules owned by this controller on graceful shutdown. "+
+			"Only for ephemeral deployments: rules are also removed on rolling restarts.")
+	flag.StringVar(&ingressClassController, "ingress-class-controller", "loxilb.io/loxilb-ingress",
+		"Handle the Ingresses whose IngressClass has this spec.controller. Empty handles all Ingresses.")
+	flag.IntVar(&maxRuleEndpoints, "max-endpoints-per-rule", 0,
+		"Program at most this many endpoints per loxilb rule, chosen as a stable subset of the backend. "+
+			"0 programs every endpoint.")
+	flag.DurationVar(&backendDebounce, "backend-debounce", time.Second,
+		"Delay reconciles triggered by backend Service and Endpoints changes until no change came for this long "+
+			"(at most 10 times this long), so that bursts of changes are programmed at once. 0 disables the delay.")
+	flag.IntVar(&breakerThreshold, "loxilb-breaker-threshold", 0,
+		"Number of consecutive failed loxilb API calls after which calls are suspended until loxilb recovers. 0 disables the circuit breaker.")
+	flag.DurationVar(&breakerCooldown, "loxilb-breaker-cooldown", 30*time.Second,
+		"How long the circuit breaker suspends loxilb API calls before probing loxilb again.")
+	flag.Float64Var(&retryBudget, "loxilb-retry-budget", 0.2,
+		"Retries of failed loxilb updates allowed per first attempt, shedding excess retries "+
+			"while loxilb keeps failing. 0 disables the budget.")
+	flag.DurationVar(&deletionGracePeriod, "deletion-grace-period", 0,
+		"Keep the loxilb rules of a deleted Ingress serving for this long, so in-flight requests can finish. "+
+			"The finalizer holds the Ingress meanwhile; with --finalizer=\"\", an Ingress recreated meanwhile "+
+			"takes the rules back. 0 deletes them at once.")
+	flag.BoolVar(&requireOptIn, "require-opt-in", false,
+		"Only handle Ingresses of the loxilb class that are also annotated with loxilb.io/enabled: \"true\".")
+	flag.BoolVar(&skipStatusUpdate, "skip-status-update", false,
+		"Do not write the status of Ingresses, for setups where another actor owns it. "+
+			"Ingresses annotated with loxilb.io/skip-status-update: \"true\" are skipped regardless.")
+	flag.StringVar(&finalizer, "finalizer", managers.DefaultFinalizer,
+		"Finalizer holding the deletion of Ingresses until their loxilb rules are deleted. "+
+			"Empty disables it, and rules are deleted after the Ingress is gone.")
+	flag.StringVar(&nodeName, "node-name", os.Getenv("NODE_NAME"),
+		"The node this pod runs on. Backends with externalTrafficPolicy Local only get their endpoints "+
+			"on this node. Empty uses all endpoints.")
+	flag.BoolVar(&nginxCompat, "nginx-compat", false,
+		"Translate common nginx.ingress.kubernetes.io annotations to their loxilb equivalents.")
+	flag.IntVar(&maxRules, "max-rules-per-ingress", 1000,
+		"Maximum number of loxilb rules one Ingress may generate. 0 disables the limit.")
+	flag.IntVar(&maxEndpoints, "max-endpoints-per-ingress", 10000,
+		"Maximum number of loxilb endpoints one Ingress may generate. 0 disables the limit.")
+	flag.DurationVar(&healthWindow, "loxilb-health-window", 5*time.Minute,
+		"Time window over which the success rate of loxilb API calls is measured.")
+	flag.Float64Var(&healthThreshold, "loxilb-health-threshold", 0,
+		"Fail the readiness check when the success rate of loxilb API calls drops below this fraction. "+
+			"0 disables the check.")
+	flag.BoolVar(&exportIngresses, "export-ingresses", false,
+		"Print the Ingresses reconstructed from the live loxilb rules as YAML and exit. "+
+			"The reconstruction is best-effort, see managers.ExportIngresses for the lossy fields.")
+	flag.StringVar(&ruleNamePrefix, "rule-name-prefix", "",
+		"Prefix of the names of the loxilb rules, e.g. \"ingctl-\", to tell them apart from the rules of other loxilb tooling. "+
+			"Existing rules named without it are recreated under the prefixed name.")
+	flag.StringVar(&validateFile, "validate", "",
+		"Validate the Ingresses of this YAML file offline, along with the Services, Endpoints, IngressClasses "+
+			"and ConfigMaps it holds, as configured by the other flags, print the loxilb rules they produce and exit. Needs no cluster.")
+	flag.BoolVar(&enableLogLevelEndpoint, "enable-loglevel-endpoint", false,
+		"Serve GET/PUT /loglevel on the metrics server to change the log level at runtime. "+
+			"The metrics server is unauthenticated: only enable it where its port is not reachable by untrusted clients.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -67,31 +183,34 @@ func main() {
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
+	logLevel := getLogLevel(&opts)
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                 scheme,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "32179f51.loxilb.io",
-		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
-		// when the Manager ends. This requires the binary to immediately end when the
-		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
-		// speeds up voluntary leader transitions as the new leader don't have to wait
-		// LeaseDuration time first.
-		//
-		// In the default scaffold provided, the program ends immediately after
-		// the manager stops, so would be fine to enable this option. However,
-		// if you are doing or is intended to do any operation such as perform cleanups
-		// after the manager stops then its usage might be unsafe.
-		// LeaderElectionReleaseOnCancel: true,
-	})
+	nsSelector, err := labels.Parse(namespaceSelector)
 	if err != nil {
-		setupLog.Error(err, "unable to create manager")
+		setupLog.Error(err, "invalid namespace selector", "selector", namespaceSelector)
 		os.Exit(1)
 	}
 
-	go pkg.SpawnLoxiLB()
+	if validateFile != "" {
+		valid, err := runValidate(validateFile, managers.ValidateOptions{
+			ExternalIP:             loxilbIngressIP,
+			ExternalIPv6:           loxilbIngressIPv6,
+			RuleNamePrefix:         ruleNamePrefix,
+			NginxCompat:            nginxCompat,
+			MaxRulesPerIngress:     maxRules,
+			MaxEndpointsPerIngress: maxEndpoints,
+			MaxEndpointsPerRule:    maxRuleEndpoints,
+		})
+		if err != nil {
+			setupLog.Error(err, "failed to validate manifests", "file", validateFile)
+			os.Exit(1)
+		}
+		if !valid {
+			os.Exit(2)
+		}
+		return
+	}
 
 	if loxilbIngressIP == "127.0.0.1" {
 		myIP, _ := pkg.GetLocalNonLoopBackIP()
@@ -100,19 +219,75 @@ func main() {
 		}
 	}
 
+	loxiLBUrl := fmt.Sprintf("http://%s:11111", loxilbIngressIP)
+
+	if exportIngresses {
+		if err := runExportIngresses(loxiLBUrl, ruleNamePrefix, []string{loxilbIngressIP, loxilbIngressIPv6}); err != nil {
+			setupLog.Error(err, "failed to export ingresses")
+			os.Exit(1)
+		}
+		return
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), newManagerOptions(probeAddr, pprofAddr, enableLeaderElection))
+	if err != nil {
+		setupLog.Error(err, "unable to create manager")
+		os.Exit(1)
+	}
+
+	if enableLogLevelEndpoint {
+		if err := mgr.AddMetricsServerExtraHandler("/loglevel", logLevel); err != nil {
+			setupLog.Error(err, "unable to set up log level endpoint")
+			os.Exit(1)
+		}
+	}
+
+	go pkg.SpawnLoxiLB()
+
 	loxiLBLiveCh := make(chan *loxiapi.LoxiClient)
 	loxiLBDeadCh := make(chan struct{})
-	loxiLBUrl := fmt.Sprintf("http://%s:11111", loxilbIngressIP)
 	loxiClient, err := loxiapi.NewLoxiClient(loxiLBUrl, loxiLBLiveCh, loxiLBDeadCh, false, false)
 	if err != nil {
 		setupLog.Error(err, "failed to create LoxiLB Client")
 		os.Exit(1)
 	}
 
+	var loxiRateLimiter flowcontrol.RateLimiter
+	if loxiQPS > 0 {
+		loxiRateLimiter = flowcontrol.NewTokenBucketRateLimiter(float32(loxiQPS), loxiBurst)
+	}
+
 	if err = (&managers.LoxilbIngressReconciler{
-		Client:     mgr.GetClient(),
-		Scheme:     mgr.GetScheme(),
-		LoxiClient: loxiClient,
+		Client:                    mgr.GetClient(),
+		Scheme:                    mgr.GetScheme(),
+		Recorder:                  mgr.GetEventRecorderFor("loxilb-ingress"),
+		LoxiClient:                loxiClient,
+		NamespaceSelector:         nsSelector,
+		ClusterDomain:             clusterDomain,
+		DNSResyncPeriod:           dnsResyncPeriod,
+		InitialSyncTimeout:        initialSyncTimeout,
+		MigrateBackendAnnotations: migrateBackendAnnotations,
+		LoxiRateLimiter:           loxiRateLimiter,
+		CleanupOnShutdown:         cleanupOnShutdown,
+		MaxRulesPerIngress:        maxRules,
+		MaxEndpointsPerIngress:    maxEndpoints,
+		IngressClassController:    ingressClassController,
+		MaxEndpointsPerRule:       maxRuleEndpoints,
+		BackendDebounce:           backendDebounce,
+		RetryBudget:               retryBudget,
+		BreakerThreshold:          breakerThreshold,
+		FullResyncPeriod:          fullResyncPeriod,
+		BreakerCooldown:           breakerCooldown,
+		DeletionGracePeriod:       deletionGracePeriod,
+		RequireOptIn:              requireOptIn,
+		SkipStatusUpdate:          skipStatusUpdate,
+		ExternalIPv6:              loxilbIngressIPv6,
+		RuleNamePrefix:            ruleNamePrefix,
+		NginxCompat:               nginxCompat,
+		NodeName:                  nodeName,
+		Finalizer:                 finalizer,
+		HealthWindow:              healthWindow,
+		HealthThreshold:           healthThreshold,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create manager", "manager", "LoxilbIngress")
 		os.Exit(1)
@@ -134,3 +309,90 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// getLogLevel returns the level of the loggers built from opts, set by --zap-log-level or
+// info by default. With --enable-loglevel-endpoint, it can be changed at runtime with
+// GET/PUT /loglevel on the metrics server.
+func getLogLevel(opts *zap.Options) uberzap.AtomicLevel {
+	logLevel, isok := opts.Level.(uberzap.AtomicLevel)
+	if !isok {
+		logLevel = uberzap.NewAtomicLevelAt(zapcore.InfoLevel)
+		opts.Level = logLevel
+	}
+	return logLevel
+}
+
+// newManagerOptions returns the options of the manager. The pprof endpoint is only served
+// when pprofAddr is set.
+func newManagerOptions(probeAddr, pprofAddr string, enableLeaderElection bool) ctrl.Options {
+	return ctrl.Options{
+		Scheme:                 scheme,
+		HealthProbeBindAddress: probeAddr,
+		PprofBindAddress:       pprofAddr,
+		LeaderElection:         enableLeaderElection,
+		LeaderElectionID:       "32179f51.loxilb.io",
+		// IngressClass parameters are the only ConfigMaps read, so read them directly
+		// rather than caching every ConfigMap of the cluster
+		Client: client.Options{
+			Cache: &client.CacheOptions{DisableFor: []client.Object{&corev1.ConfigMap{}}},
+		},
+		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
+		// when the Manager ends. This requires the binary to immediately end when the
+		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
+		// speeds up voluntary leader transitions as the new leader don't have to wait
+		// LeaseDuration time first.
+		//
+		// In the default scaffold provided, the program ends immediately after
+		// the manager stops, so would be fine to enable this option. However,
+		// if you are doing or is intended to do any operation such as perform cleanups
+		// after the manager stops then its usage might be unsafe.
+		// LeaderElectionReleaseOnCancel: true,
+	}
+}
+
+// runExportIngresses prints the Ingresses reconstructed from the rules of the loxilb at
+// loxiLBUrl and named with prefix as a multi-document YAML stream. The settings that could
+// not be restored are logged.
+func runExportIngresses(loxiLBUrl, prefix string, externalIPs []string) error {
+	ctx := context.Background()
+
+	k8sClient, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	loxiClient, err := loxiapi.NewLoxiClient(loxiLBUrl, make(chan *loxiapi.LoxiClient, 1), make(chan struct{}, 1), false, false)
+	if err != nil {
+		return err
+	}
+
+	lbList, err := loxiClient.LoadBalancer().List(ctx)
+	if err != nil {
+		return err
+	}
+	ingresses, warnings, err := managers.ExportIngresses(ctx, k8sClient, lbList.Item, prefix, externalIPs)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		setupLog.Info("setting not exported", "warning", warning)
+	}
+
+	for _, ingress := range ingresses {
+		out, err := yaml.Marshal(&ingress)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("---\n%s", out)
+	}
+	return nil
+}
+
+// runValidate validates the Ingresses of the manifests in file offline, as if programmed
+// with options.
+func runValidate(file string, options managers.ValidateOptions) (bool, error) {
+	manifests, err := os.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	return managers.ValidateManifests(context.Background(), scheme, manifests, options, os.Stdout)
+}
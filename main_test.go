@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestPprofEndpoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+	}{
+		{name: "disabled by default"},
+		{name: "enabled", enabled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := freeAddr(t)
+			pprofAddr := ""
+			if tt.enabled {
+				pprofAddr = addr
+			}
+			options := newManagerOptions("0", pprofAddr, false)
+			options.Metrics = metricsserver.Options{BindAddress: "0"}
+			mgr, err := ctrl.NewManager(&rest.Config{Host: "http://127.0.0.1:1"}, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() { done <- mgr.Start(ctx) }()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			// the HTTP servers are started before the manager is elected
+			<-mgr.Elected()
+			served := false
+			for i := 0; i < 20 && !served; i++ {
+				resp, err := http.Get(fmt.Sprintf("http://%s/debug/pprof/", addr))
+				if err == nil {
+					served = resp.StatusCode == http.StatusOK
+					resp.Body.Close()
+				} else if !tt.enabled {
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			if served != tt.enabled {
+				t.Errorf("pprof served on %s = %t, want %t", addr, served, tt.enabled)
+			}
+		})
+	}
+}
+
+func TestLogLevelEndpoint(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantDebug bool
+	}{
+		{name: "info by default"},
+		{name: "flag", args: []string{"--zap-log-level=debug"}, wantDebug: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := zap.Options{Development: true}
+			flags := flag.NewFlagSet(tt.name, flag.ContinueOnError)
+			opts.BindFlags(flags)
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			out := &bytes.Buffer{}
+			logLevel := getLogLevel(&opts)
+			logger := zap.New(zap.UseFlagOptions(&opts), zap.WriteTo(out))
+
+			// each step sets the level through the endpoint, unless empty
+			steps := []struct {
+				level     string
+				wantDebug bool
+			}{
+				{wantDebug: tt.wantDebug},
+				{level: "debug", wantDebug: true},
+				{level: "info"},
+			}
+			for _, step := range steps {
+				if step.level != "" {
+					body := strings.NewReader(fmt.Sprintf(`{"level": %q}`, step.level))
+					resp := httptest.NewRecorder()
+					logLevel.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/loglevel", body))
+					if resp.Code != http.StatusOK {
+						t.Fatalf("PUT /loglevel %s: %d %s", step.level, resp.Code, resp.Body)
+					}
+				}
+
+				out.Reset()
+				logger.V(1).Info("debug message")
+				if logged := out.Len() > 0; logged != step.wantDebug {
+					t.Errorf("level %q: debug message logged = %t, want %t", step.level, logged, step.wantDebug)
+				}
+			}
+		})
+	}
+}
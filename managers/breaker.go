@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// loxiCircuitOpenGauge exposes the state of the loxilb circuit breaker.
+var loxiCircuitOpenGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "loxilb_ingress_circuit_breaker_open",
+	Help: "Whether calls to the loxilb API are suspended after consecutive failures (1) or not (0).",
+})
+
+func init() {
+	metrics.Registry.MustRegister(loxiCircuitOpenGauge)
+}
+
+// loxiCircuitBreaker suspends the loxilb API calls after consecutive failures, so that work
+// does not pile up against a dead loxilb. Once the cooldown has passed, a single call is let
+// through as a probe: its success closes the breaker, its failure opens it for another cooldown.
+type loxiCircuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether a loxilb API call may proceed.
+func (b *loxiCircuitBreaker) allow(cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records the outcome of a loxilb API call, and returns whether the breaker changed state.
+func (b *loxiCircuitBreaker) record(ok bool, threshold int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+
+	if ok {
+		b.failures = 0
+		if b.open {
+			b.open = false
+			loxiCircuitOpenGauge.Set(0)
+			return true
+		}
+		return false
+	}
+
+	b.failures++
+	if b.open {
+		b.openedAt = time.Now()
+		return false
+	}
+	if b.failures >= threshold {
+		b.open = true
+		b.openedAt = time.Now()
+		loxiCircuitOpenGauge.Set(1)
+		return true
+	}
+	return false
+}
+
+func (b *loxiCircuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// checkLoxiCircuit is a health check failing while the loxilb circuit breaker is open.
+func (r *LoxilbIngressReconciler) checkLoxiCircuit(_ *http.Request) error {
+	if r.breaker.isOpen() {
+		return errors.New("loxilb circuit breaker is open")
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	loxiapi "github.com/loxilb-io/kube-loxilb/pkg/api"
+)
+
+// failingLoadBalancerAPI fails every call while err is set, and counts the calls.
+type failingLoadBalancerAPI struct {
+	*fakeLoadBalancerAPI
+	err   error
+	calls int
+}
+
+func (f *failingLoadBalancerAPI) Create(ctx context.Context, obj loxiapi.LoxiModel) error {
+	f.calls++
+	if f.err != nil {
+		return f.err
+	}
+	return f.fakeLoadBalancerAPI.Create(ctx, obj)
+}
+
+func TestLoxiCircuitBreakerOpens(t *testing.T) {
+	breaker := &loxiCircuitBreaker{}
+	for i := 0; i < 2; i++ {
+		if breaker.record(false, 3) {
+			t.Fatalf("breaker changed state after %d failures, want it closed until 3", i+1)
+		}
+	}
+	// a success resets the consecutive failures
+	breaker.record(true, 3)
+	breaker.record(false, 3)
+	breaker.record(false, 3)
+	if breaker.isOpen() {
+		t.Fatalf("breaker open after a success, want the failures reset")
+	}
+
+	if !breaker.record(false, 3) || !breaker.isOpen() {
+		t.Fatalf("breaker closed after 3 consecutive failures, want it open")
+	}
+	if breaker.allow(time.Minute) {
+		t.Errorf("call allowed during the cooldown")
+	}
+}
+
+func TestLoxiCircuitBreakerProbes(t *testing.T) {
+	breaker := &loxiCircuitBreaker{}
+	breaker.record(false, 1)
+	breaker.openedAt = time.Now().Add(-time.Minute)
+
+	if !breaker.allow(time.Second) {
+		t.Fatalf("probe refused after the cooldown")
+	}
+	if breaker.allow(time.Second) {
+		t.Fatalf("second call allowed while the probe is in flight")
+	}
+
+	// a failed probe opens the breaker for another cooldown
+	if breaker.record(false, 1) || !breaker.isOpen() {
+		t.Fatalf("breaker closed after a failed probe")
+	}
+	if breaker.allow(time.Second) {
+		t.Fatalf("call allowed right after a failed probe")
+	}
+
+	breaker.openedAt = time.Now().Add(-time.Minute)
+	if !breaker.allow(time.Second) {
+		t.Fatalf("probe refused after the second cooldown")
+	}
+	if !breaker.record(true, 1) || breaker.isOpen() {
+		t.Fatalf("breaker open after a successful probe, want it closed")
+	}
+	if !breaker.allow(time.Second) {
+		t.Errorf("call refused with the breaker closed")
+	}
+}
+
+func TestLoxiCircuitBreakerSuspendsCalls(t *testing.T) {
+	lb := &failingLoadBalancerAPI{fakeLoadBalancerAPI: newFakeLoadBalancerAPI(), err: errors.New("connection refused")}
+	r := &LoxilbIngressReconciler{
+		LoadBalancerAPI:  lb,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+	}
+	model := &loxiapi.LoadBalancerModel{Service: loxiapi.LoadBalancerService{ExternalIP: testExternalIP, Port: 80, Protocol: "tcp"}}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := r.createLoxiModel(ctx, model); err == nil || errors.Is(err, ErrLoxiCircuitOpen) {
+			t.Fatalf("call %d: error = %v, want the loxilb error", i, err)
+		}
+	}
+	err := r.createLoxiModel(ctx, model)
+	if !errors.Is(err, ErrLoxiCircuitOpen) {
+		t.Fatalf("error = %v, want %v", err, ErrLoxiCircuitOpen)
+	}
+	if lb.calls != 2 {
+		t.Errorf("loxilb called %d times, want 2", lb.calls)
+	}
+	if requeue, isok := r.getLoxiThrottleRequeue(err); !isok || requeue != r.BreakerCooldown {
+		t.Errorf("requeue = %s, %t, want the cooldown", requeue, isok)
+	}
+	if r.checkLoxiCircuit(nil) == nil {
+		t.Errorf("readiness check passed with the breaker open")
+	}
+
+	// once loxilb recovers, the probe after the cooldown closes the breaker
+	lb.err = nil
+	r.breaker.openedAt = time.Now().Add(-r.BreakerCooldown)
+	if err := r.createLoxiModel(ctx, model); err != nil {
+		t.Fatalf("probe error = %v, want none", err)
+	}
+	if r.checkLoxiCircuit(nil) != nil {
+		t.Errorf("readiness check failed with the breaker closed")
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// retryBudgetMinTokens is the balance the budget is topped up to every
+	// retryBudgetRefillInterval, which lets a few retries through even without first
+	// attempts, so that a quiet controller can still recover from isolated failures.
+	retryBudgetMinTokens      = 10
+	retryBudgetRefillInterval = time.Minute
+	// retryBudgetMaxTokens bounds the retries saved up while loxilb is healthy.
+	retryBudgetMaxTokens = 100
+	// retryBudgetRequeue is how long a retry refused by the budget is deferred.
+	retryBudgetRequeue = 5 * time.Second
+)
+
+// retryBudget caps the retries of failed loxilb updates to a fraction of the first attempts:
+// every first attempt deposits ratio tokens, every retry withdraws one. While loxilb keeps
+// failing, the budget runs dry and retries are shed back to the workqueue instead of
+// hammering loxilb.
+type retryBudget struct {
+	mu         sync.Mutex
+	ratio      float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.ratio, retryBudgetMaxTokens)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Since(b.lastRefill) >= retryBudgetRefillInterval {
+		b.tokens = max(b.tokens, retryBudgetMinTokens)
+		b.lastRefill = time.Now()
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// acquireRetryBudget reports whether the loxilb update of Ingress key may proceed. First
+// attempts always may; retries of a failed update need a token of the retry budget.
+func (r *LoxilbIngressReconciler) acquireRetryBudget(key types.NamespacedName) bool {
+	if r.RetryBudget <= 0 {
+		return true
+	}
+
+	if _, isRetry := r.failedKeys.Load(key); isRetry {
+		return r.retries.withdraw()
+	}
+	r.retries.deposit()
+	return true
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRetryBudgetShedsRetries(t *testing.T) {
+	r := &LoxilbIngressReconciler{RetryBudget: 0.5}
+	r.retries.ratio = r.RetryBudget
+	failed := types.NamespacedName{Namespace: "default", Name: "failed"}
+	r.failedKeys.Store(failed, struct{}{})
+
+	// the floor lets a few retries through without any first attempt
+	for i := 0; i < retryBudgetMinTokens; i++ {
+		if !r.acquireRetryBudget(failed) {
+			t.Fatalf("retry %d refused, want the first %d allowed", i, retryBudgetMinTokens)
+		}
+	}
+	if r.acquireRetryBudget(failed) {
+		t.Fatalf("retry allowed with an exhausted budget")
+	}
+
+	// first attempts are never shed, and earn retries
+	for i := 0; i < 4; i++ {
+		if !r.acquireRetryBudget(types.NamespacedName{Namespace: "default", Name: "new"}) {
+			t.Fatalf("first attempt refused")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if !r.acquireRetryBudget(failed) {
+			t.Fatalf("retry %d refused, want 2 earned by 4 first attempts", i)
+		}
+	}
+	if r.acquireRetryBudget(failed) {
+		t.Errorf("retry allowed beyond the earned ones")
+	}
+}
+
+func TestRetryBudgetFloor(t *testing.T) {
+	budget := &retryBudget{ratio: 1}
+	for budget.withdraw() {
+	}
+
+	// the floor is a top-up once per interval, not a balance granted on every withdrawal
+	if budget.withdraw() {
+		t.Fatalf("withdraw allowed before the refill interval passed")
+	}
+	budget.lastRefill = time.Now().Add(-retryBudgetRefillInterval)
+	withdrawn := 0
+	for budget.withdraw() {
+		withdrawn++
+	}
+	if withdrawn != retryBudgetMinTokens {
+		t.Errorf("withdrew %d after the refill, want %d", withdrawn, retryBudgetMinTokens)
+	}
+}
+
+func TestRetryBudgetMax(t *testing.T) {
+	budget := &retryBudget{ratio: 1, lastRefill: time.Now()}
+	for i := 0; i < 2*retryBudgetMaxTokens; i++ {
+		budget.deposit()
+	}
+	if budget.tokens != retryBudgetMaxTokens {
+		t.Errorf("tokens = %v, want the %d cap", budget.tokens, retryBudgetMaxTokens)
+	}
+}
+
+func TestRetryBudgetDisabled(t *testing.T) {
+	r := &LoxilbIngressReconciler{}
+	failed := types.NamespacedName{Namespace: "default", Name: "failed"}
+	r.failedKeys.Store(failed, struct{}{})
+	for i := 0; i < 2*retryBudgetMaxTokens; i++ {
+		if !r.acquireRetryBudget(failed) {
+			t.Fatalf("retry refused with the budget disabled")
+		}
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// ingressClassIndexKey indexes Ingresses by the name of their IngressClass.
+	ingressClassIndexKey = "spec.ingressClassName"
+	// legacyIngressClassAnnotation is the class annotation predating spec.ingressClassName.
+	legacyIngressClassAnnotation = "kubernetes.io/ingress.class"
+)
+
+func getIngressClassName(ingress *netv1.Ingress) string {
+	if ingress.Spec.IngressClassName != nil {
+		return *ingress.Spec.IngressClassName
+	}
+	return ingress.Annotations[legacyIngressClassAnnotation]
+}
+
+func indexIngressClassName(obj client.Object) []string {
+	ingress, isok := obj.(*netv1.Ingress)
+	if !isok {
+		return nil
+	}
+
+	if className := getIngressClassName(ingress); className != "" {
+		return []string{className}
+	}
+	return nil
+}
+
+// isIngressClassHandled reports whether the Ingress belongs to this controller. The class is
+// matched by the spec.controller of its IngressClass, whatever the class is named. Ingresses
+// without a class are handled unless the default IngressClass belongs to another controller.
+func (r *LoxilbIngressReconciler) isIngressClassHandled(ctx context.Context, ingress *netv1.Ingress) bool {
+	if r.IngressClassController == "" {
+		return true
+	}
+
+	className := getIngressClassName(ingress)
+	if className != "" {
+		class := &netv1.IngressClass{}
+		if err := r.Client.Get(ctx, types.NamespacedName{Name: className}, class); err != nil {
+			log.FromContext(ctx).V(1).Info("failed to get ingress class", "class", className, "error", err.Error())
+			return false
+		}
+		return class.Spec.Controller == r.IngressClassController
+	}
+
+	classList := &netv1.IngressClassList{}
+	if err := r.Client.List(ctx, classList); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list ingress classes")
+		return false
+	}
+	for _, class := range classList.Items {
+		if isDefaultIngressClass(&class) && class.Spec.Controller != r.IngressClassController {
+			return false
+		}
+	}
+	return true
+}
+
+func isDefaultIngressClass(class *netv1.IngressClass) bool {
+	return class.Annotations[netv1.AnnotationIsDefaultIngressClass] == "true"
+}
+
+// findIngressesForClass enqueues the Ingresses of a changed IngressClass, and the Ingresses
+// without a class when it is the default class, so they are (un)programmed accordingly.
+func (r *LoxilbIngressReconciler) findIngressesForClass(ctx context.Context, obj client.Object) []reconcile.Request {
+	ingresses, err := r.listIngressesOfClass(ctx, obj)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "failed to list ingresses", "class", obj.GetName())
+		return nil
+	}
+	return r.dirtyIngressRequests(ingresses)
+}
+
+// listIngressesOfClass returns the Ingresses of class, and the Ingresses without a class
+// when it is the default class.
+func (r *LoxilbIngressReconciler) listIngressesOfClass(ctx context.Context, obj client.Object) ([]netv1.Ingress, error) {
+	ingressList := &netv1.IngressList{}
+	if err := r.Client.List(ctx, ingressList,
+		client.MatchingFields{ingressClassIndexKey: obj.GetName()}); err != nil {
+		return nil, err
+	}
+	ingresses := ingressList.Items
+
+	if class, isok := obj.(*netv1.IngressClass); isok && isDefaultIngressClass(class) {
+		allIngressList := &netv1.IngressList{}
+		if err := r.Client.List(ctx, allIngressList); err != nil {
+			return nil, err
+		}
+		for _, ingress := range allIngressList.Items {
+			if getIngressClassName(&ingress) == "" {
+				ingresses = append(ingresses, ingress)
+			}
+		}
+	}
+	return ingresses, nil
+}
+
+// getParametersConfigMap returns the ConfigMap referenced by the parameters of class, if any.
+func getParametersConfigMap(class *netv1.IngressClass) (types.NamespacedName, bool) {
+	params := class.Spec.Parameters
+	if params == nil || params.Kind != "ConfigMap" || params.Namespace == nil {
+		return types.NamespacedName{}, false
+	}
+	if params.APIGroup != nil && *params.APIGroup != "" {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: *params.Namespace, Name: params.Name}, true
+}
+
+// getIngressClassDefaults returns the default annotations of the Ingress: the data of the
+// ConfigMap referenced by the parameters of its IngressClass, or of the default class for
+// Ingresses without a class. A missing ConfigMap gives no defaults, with a warning event.
+func (r *LoxilbIngressReconciler) getIngressClassDefaults(ctx context.Context, ingress *netv1.Ingress) (map[string]string, error) {
+	var class *netv1.IngressClass
+	if className := getIngressClassName(ingress); className != "" {
+		class = &netv1.IngressClass{}
+		if err := r.Client.Get(ctx, types.NamespacedName{Name: className}, class); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+	} else {
+		classList := &netv1.IngressClassList{}
+		if err := r.Client.List(ctx, classList); err != nil {
+			return nil, err
+		}
+		for i := range classList.Items {
+			if isDefaultIngressClass(&classList.Items[i]) {
+				class = &classList.Items[i]
+				break
+			}
+		}
+		if class == nil {
+			return nil, nil
+		}
+	}
+
+	key, isok := getParametersConfigMap(class)
+	if !isok {
+		return nil, nil
+	}
+	configMap := &corev1.ConfigMap{}
+	if err := r.Client.Get(ctx, key, configMap); err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+		// the parameters watch reconciles the Ingress once the ConfigMap is created
+		r.Recorder.Eventf(ingress, corev1.EventTypeWarning, "IngressClassParametersNotFound",
+			"ConfigMap %s referenced by the parameters of IngressClass %s not found, using no defaults", key, class.Name)
+		return nil, nil
+	}
+	return configMap.Data, nil
+}
+
+// applyIngressClassDefaults returns a copy of the Ingress with the defaults added to the
+// annotations it does not set itself.
+func applyIngressClassDefaults(ingress *netv1.Ingress, defaults map[string]string) *netv1.Ingress {
+	ingress = ingress.DeepCopy()
+	if ingress.Annotations == nil {
+		ingress.Annotations = make(map[string]string, len(defaults))
+	}
+	for key, value := range defaults {
+		if _, isok := ingress.Annotations[key]; !isok {
+			ingress.Annotations[key] = value
+		}
+	}
+	return ingress
+}
+
+// findIngressesForParameters enqueues the Ingresses of the IngressClasses whose parameters
+// reference a changed ConfigMap, so that new defaults take effect.
+func (r *LoxilbIngressReconciler) findIngressesForParameters(ctx context.Context, obj client.Object) []reconcile.Request {
+	classList := &netv1.IngressClassList{}
+	if err := r.Client.List(ctx, classList); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list ingress classes")
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0)
+	for i := range classList.Items {
+		key, isok := getParametersConfigMap(&classList.Items[i])
+		if !isok || key.Namespace != obj.GetNamespace() || key.Name != obj.GetName() {
+			continue
+		}
+		requests = append(requests, r.findIngressesForClass(ctx, &classList.Items[i])...)
+	}
+	return requests
+}
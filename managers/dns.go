@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	loxiapi "github.com/loxilb-io/kube-loxilb/pkg/api"
+)
+
+// Resolver looks up the addresses of a DNS name. *net.Resolver satisfies it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// resolveLoxiLoadBalancerEndpoints builds the loxilb endpoints of a service from the
+// A/AAAA records of its cluster DNS name, on the targetPort of service port port. It
+// returns an error when the name does not resolve to any valid address, so the caller can
+// fall back to the Endpoints object.
+func (r *LoxilbIngressReconciler) resolveLoxiLoadBalancerEndpoints(ctx context.Context, ns, name string, port int32) ([]loxiapi.LoadBalancerEndpoint, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	targetPort, err := r.getServiceTargetPort(ctx, ns, name, port)
+	if err != nil {
+		return nil, err
+	}
+
+	host := fmt.Sprintf("%s.%s.svc.%s", name, ns, r.ClusterDomain)
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep the order stable so re-resolving does not look like a change
+	sort.Strings(addrs)
+	loxilbEpList := make([]loxiapi.LoadBalancerEndpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		if net.ParseIP(addr) == nil {
+			log.FromContext(ctx).Info("ignore invalid address", "host", host, "address", addr)
+			continue
+		}
+		loxilbEpList = append(loxilbEpList, loxiapi.LoadBalancerEndpoint{
+			EndpointIP: addr,
+			TargetPort: uint16(targetPort),
+			Weight:     uint8(1),
+		})
+	}
+
+	if len(loxilbEpList) == 0 {
+		return nil, fmt.Errorf("%s resolved to no valid address", host)
+	}
+	return loxilbEpList, nil
+}
+
+// getServiceTargetPort returns the targetPort of the port numbered port of service ns/name.
+// A named targetPort is resolved through the Endpoints of the service, which carry the
+// container port it names.
+func (r *LoxilbIngressReconciler) getServiceTargetPort(ctx context.Context, ns, name string, port int32) (int32, error) {
+	svcPort, err := r.getServicePort(ctx, ns, name, port)
+	if err != nil || svcPort == nil {
+		return port, err
+	}
+
+	switch {
+	case svcPort.TargetPort.Type == intstr.Int && svcPort.TargetPort.IntVal != 0:
+		return svcPort.TargetPort.IntVal, nil
+	case svcPort.TargetPort.Type == intstr.String && svcPort.TargetPort.StrVal != "":
+		ep := &corev1.Endpoints{}
+		if err := r.Client.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, ep); err != nil {
+			return 0, err
+		}
+		for _, subset := range ep.Subsets {
+			for _, epPort := range subset.Ports {
+				if epPort.Name == svcPort.Name {
+					return epPort.Port, nil
+				}
+			}
+		}
+		return 0, fmt.Errorf("targetPort %s of service %s/%s is not resolved by its endpoints", svcPort.TargetPort.StrVal, ns, name)
+	}
+	return port, nil
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	netv1 "k8s.io/api/networking/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"loxilb.io/loxilb-ingress-manager/pkg"
+)
+
+// stubResolver resolves the hosts it holds, and fails the others.
+type stubResolver map[string][]string
+
+func (s stubResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	addrs, isok := s[host]
+	if !isok {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	return addrs, nil
+}
+
+func TestReconcileDNSDiscovery(t *testing.T) {
+	resolver := stubResolver{
+		"web.default.svc.cluster.local":   {"10.0.9.2", "10.0.9.1"},
+		"named.default.svc.cluster.local": {"10.0.9.3", "not-an-ip"},
+	}
+
+	tests := []struct {
+		name    string
+		ingress *netv1.Ingress
+		objs    []client.Object
+		want    []string
+	}{
+		{
+			name:    "numbered target port",
+			ingress: testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"})),
+			want:    []string{"10.0.9.1:8080", "10.0.9.2:8080"},
+		},
+		{
+			name: "named target port",
+			ingress: func() *netv1.Ingress {
+				ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "named"}))
+				ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Port.Number = 8000
+				return ingress
+			}(),
+			objs: testNamedPortBackend("named", "10.0.3.1"),
+			want: []string{"10.0.9.3:9090"},
+		},
+		{
+			name:    "falls back to endpoints",
+			ingress: testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "api"})),
+			want:    []string{"10.0.1.1:8080"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ingress.Annotations = map[string]string{pkg.EndpointDiscoveryAnnotation: "dns"}
+			r, lb := newTestReconciler(t, testFixtures(append(tt.objs, tt.ingress)...)...)
+			r.Resolver = resolver
+			r.ClusterDomain = "cluster.local"
+			reconcileIngress(t, r, tt.ingress.Name)
+
+			if got := lb.endpoints()[testRuleKey(80, "a.example.com")]; fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("endpoints = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
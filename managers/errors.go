@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLoxiRateLimited is returned instead of calling loxilb when the client-side rate limit is exceeded.
+var ErrLoxiRateLimited = errors.New("loxilb API rate limit exceeded")
+
+// ErrLoxiCircuitOpen is returned instead of calling loxilb while the circuit breaker is open.
+var ErrLoxiCircuitOpen = errors.New("loxilb circuit breaker is open")
+
+// BackendPortNotFoundError is returned when an Ingress backend refers to a port
+// that its Service does not expose.
+type BackendPortNotFoundError struct {
+	Namespace string
+	Service   string
+	Port      string
+}
+
+func (e *BackendPortNotFoundError) Error() string {
+	return fmt.Sprintf("service %s/%s has no port %s", e.Namespace, e.Service, e.Port)
+}
+
+// InvalidExternalIPError is returned when the external IP rules would be programmed on
+// is empty or not an IP address.
+type InvalidExternalIPError struct {
+	IP string
+}
+
+func (e *InvalidExternalIPError) Error() string {
+	if e.IP == "" {
+		return "loxilb external IP is empty"
+	}
+	return fmt.Sprintf("loxilb external IP %q is not a valid IP address", e.IP)
+}
+
+// IPFamilyUnavailableError is returned when an Ingress asks for an address family
+// loxilb-ingress has no address of.
+type IPFamilyUnavailableError struct {
+	Family string
+}
+
+func (e *IPFamilyUnavailableError) Error() string {
+	return fmt.Sprintf("loxilb-ingress has no %s address", e.Family)
+}
+
+// EpSelectConflictError is returned when paths sharing one loxilb rule (same host and port)
+// ask for different endpoint selections, which a single rule cannot honor.
+type EpSelectConflictError struct {
+	Rule string
+}
+
+func (e *EpSelectConflictError) Error() string {
+	return fmt.Sprintf("paths of loxilb rule %s use different endpoint selections; "+
+		"set the same loxilb.io/epselect for all their services", e.Rule)
+}
+
+// IngressLimitExceededError is returned when an Ingress would generate more loxilb rules
+// or endpoints than the controller is configured to program.
+type IngressLimitExceededError struct {
+	Limit string
+	Count int
+	Max   int
+}
+
+func (e *IngressLimitExceededError) Error() string {
+	return fmt.Sprintf("ingress generates %d %s, exceeding the limit of %d", e.Count, e.Limit, e.Max)
+}
+
+func isLoxiRateLimited(err error) bool {
+	return errors.Is(err, ErrLoxiRateLimited)
+}
+
+// getLoxiThrottleRequeue returns how long to defer work refused without calling loxilb,
+// by the API rate limit or the open circuit breaker.
+func (r *LoxilbIngressReconciler) getLoxiThrottleRequeue(err error) (time.Duration, bool) {
+	switch {
+	case isLoxiRateLimited(err):
+		return loxiRateLimitRequeue, true
+	case errors.Is(err, ErrLoxiCircuitOpen):
+		return r.BreakerCooldown, true
+	}
+	return 0, false
+}
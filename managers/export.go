@@ -0,0 +1,231 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"loxilb.io/loxilb-ingress-manager/pkg"
+
+	loxiapi "github.com/loxilb-io/kube-loxilb/pkg/api"
+)
+
+// ExportIngresses reconstructs, on a best-effort basis, the Ingresses that the loxilb rules
+// in models were programmed from, given the rule name prefix and the external IPs the
+// controller ran with. It is meant for disaster recovery when the Ingress manifests are
+// lost. The reconstruction is lossy:
+//   - rules do not carry paths, so every host gets a single "/" Prefix path;
+//   - the backend service is found by matching the rule endpoints against the cluster
+//     Endpoints, and is left out when no service matches (e.g. it was deleted);
+//   - TLS hosts are listed without a secretName, which must be filled in by hand;
+//   - only the security and epselect annotations are restored.
+//
+// The settings that cannot be restored, a frontend port, an external IP or ip-family
+// and L4 rules, are returned as warnings.
+func ExportIngresses(ctx context.Context, c client.Reader, models []loxiapi.LoadBalancerModel, prefix string, externalIPs []string) ([]netv1.Ingress, []string, error) {
+	endpointsList := &corev1.EndpointsList{}
+	if err := c.List(ctx, endpointsList); err != nil {
+		return nil, nil, err
+	}
+
+	ingresses := make(map[string]*netv1.Ingress)
+	names := make([]string, 0)
+	// rules programmed on several external IPs (ip-family dual) are exported once
+	exportedRules := make(map[string]struct{})
+	warnings := make([]string, 0)
+	for _, model := range models {
+		ruleName, isok := strings.CutPrefix(model.Service.Name, prefix)
+		if !isok {
+			continue
+		}
+		ns, name, isok := strings.Cut(ruleName, "_")
+		if !isok {
+			continue
+		}
+		if model.Service.Mode != loxiapi.LBModeFullProxy {
+			warnings = append(warnings, fmt.Sprintf("%s/%s: L4 rule on port %d (%s) not exported",
+				ns, name, model.Service.Port, pkg.ForceL4Annotation))
+			continue
+		}
+
+		if len(externalIPs) == 0 || model.Service.ExternalIP != externalIPs[0] {
+			setting := pkg.ExternalIPAnnotation
+			if slices.Contains(externalIPs, model.Service.ExternalIP) {
+				setting = pkg.IPFamilyAnnotation
+			}
+			warnings = append(warnings, fmt.Sprintf("%s/%s: host %q served on %s, %s not restored",
+				ns, name, model.Service.Host, model.Service.ExternalIP, setting))
+		}
+
+		ruleKey := fmt.Sprintf("%s|%s|%d|%s", model.Service.Name, model.Service.Protocol, model.Service.Port, model.Service.Host)
+		if _, isok := exportedRules[ruleKey]; isok {
+			continue
+		}
+		exportedRules[ruleKey] = struct{}{}
+
+		ingress, isok := ingresses[model.Service.Name]
+		if !isok {
+			ingress = &netv1.Ingress{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: netv1.SchemeGroupVersion.String(),
+					Kind:       "Ingress",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   ns,
+					Name:        name,
+					Annotations: make(map[string]string),
+				},
+			}
+			ingresses[model.Service.Name] = ingress
+			names = append(names, model.Service.Name)
+		}
+
+		if model.Service.Port != 80 && model.Service.Port != 443 {
+			warnings = append(warnings, fmt.Sprintf("%s/%s: host %q served on port %d, %s not restored",
+				ns, name, model.Service.Host, model.Service.Port, pkg.FrontendPortAnnotation))
+		}
+
+		// https follows from the TLS hosts, so only other modes need the annotation
+		if security, isok := pkg.FormatSecurity(model.Service.Security); isok && model.Service.Security > 1 {
+			ingress.Annotations[pkg.SecurityAnnotation] = security
+		}
+		if sel, isok := pkg.FormatEpSelect(model.Service.Sel); isok && model.Service.Sel != loxiapi.LbSelRr {
+			ingress.Annotations[pkg.EpSelectAnnotation] = sel
+		}
+		if model.Service.Security != 0 {
+			ingress.Spec.TLS = append(ingress.Spec.TLS, netv1.IngressTLS{Hosts: []string{model.Service.Host}})
+		}
+
+		rule := netv1.IngressRule{
+			Host: model.Service.Host,
+			IngressRuleValue: netv1.IngressRuleValue{
+				HTTP: &netv1.HTTPIngressRuleValue{},
+			},
+		}
+		if backend, backendNs := findExportBackend(ctx, c, ns, endpointsList.Items, model.Endpoints); backend != nil {
+			pathType := netv1.PathTypePrefix
+			rule.HTTP.Paths = append(rule.HTTP.Paths, netv1.HTTPIngressPath{
+				Path:     "/",
+				PathType: &pathType,
+				Backend:  netv1.IngressBackend{Service: backend},
+			})
+			if backendNs != ns {
+				backendNamespaces, _ := pkg.ParseBackendNamespaces(ingress.Annotations[pkg.BackendNamespacesAnnotation])
+				backendNamespaces[backend.Name] = backendNs
+				ingress.Annotations[pkg.BackendNamespacesAnnotation] = pkg.FormatBackendNamespaces(backendNamespaces)
+			}
+		}
+		ingress.Spec.Rules = append(ingress.Spec.Rules, rule)
+	}
+
+	sort.Strings(names)
+	exported := make([]netv1.Ingress, 0, len(names))
+	for _, name := range names {
+		exported = append(exported, *ingresses[name])
+	}
+	return exported, warnings, nil
+}
+
+// findExportBackend returns the service, and its namespace, whose Endpoints hold every
+// endpoint of a rule, preferring services of namespace ns. The port is the service port
+// whose Endpoints port is the one the rule targets: Endpoints ports are named after the
+// service ports, and carry the targetPort, which may differ from the service port.
+func findExportBackend(ctx context.Context, c client.Reader, ns string, endpointsList []corev1.Endpoints, eps []loxiapi.LoadBalancerEndpoint) (*netv1.IngressServiceBackend, string) {
+	if len(eps) == 0 {
+		return nil, ""
+	}
+
+	candidates := make([]corev1.Endpoints, 0)
+	for _, endpoints := range endpointsList {
+		if endpointsHoldIPs(&endpoints, eps) {
+			candidates = append(candidates, endpoints)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Namespace == ns && candidates[j].Namespace != ns
+	})
+
+	for _, endpoints := range candidates {
+		epPort, isok := findEndpointsPort(&endpoints, &eps[0])
+		if !isok {
+			continue
+		}
+		svc := &corev1.Service{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: endpoints.Namespace, Name: endpoints.Name}, svc); err != nil {
+			continue
+		}
+		for _, svcPort := range svc.Spec.Ports {
+			if svcPort.Name != epPort.Name {
+				continue
+			}
+			// a named targetPort resolves per pod, so only a numbered one can be checked
+			if svcPort.TargetPort.Type == intstr.Int && svcPort.TargetPort.IntVal != 0 &&
+				svcPort.TargetPort.IntVal != epPort.Port {
+				continue
+			}
+			return &netv1.IngressServiceBackend{
+				Name: svc.Name,
+				Port: netv1.ServiceBackendPort{Number: svcPort.Port},
+			}, svc.Namespace
+		}
+	}
+	return nil, ""
+}
+
+// findEndpointsPort returns the port of the subset of endpoints holding ep numbered like the
+// target port of ep.
+func findEndpointsPort(endpoints *corev1.Endpoints, ep *loxiapi.LoadBalancerEndpoint) (corev1.EndpointPort, bool) {
+	for _, subset := range endpoints.Subsets {
+		addresses := append(append([]corev1.EndpointAddress{}, subset.Addresses...), subset.NotReadyAddresses...)
+		if !slices.ContainsFunc(addresses, func(addr corev1.EndpointAddress) bool { return addr.IP == ep.EndpointIP }) {
+			continue
+		}
+		for _, epPort := range subset.Ports {
+			if uint16(epPort.Port) == ep.TargetPort {
+				return epPort, true
+			}
+		}
+	}
+	return corev1.EndpointPort{}, false
+}
+
+func endpointsHoldIPs(endpoints *corev1.Endpoints, eps []loxiapi.LoadBalancerEndpoint) bool {
+	ips := make(map[string]struct{})
+	for _, subset := range endpoints.Subsets {
+		for _, addr := range append(append([]corev1.EndpointAddress{}, subset.Addresses...), subset.NotReadyAddresses...) {
+			ips[addr.IP] = struct{}{}
+		}
+	}
+
+	for _, ep := range eps {
+		if _, isok := ips[ep.EndpointIP]; !isok {
+			return false
+		}
+	}
+	return true
+}
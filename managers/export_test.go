@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"loxilb.io/loxilb-ingress-manager/pkg"
+)
+
+// testNamedPortBackend returns a service exposing port 8000 on the targetPort named
+// "http-alt", with the endpoints it resolves to on port 9090.
+func testNamedPortBackend(name string, ips ...string) []client.Object {
+	svc := testService(name)
+	svc.Spec.Ports = []corev1.ServicePort{{Name: "web", Port: 8000, TargetPort: intstr.FromString("http-alt")}}
+	ep := testEndpoints(name, ips...)
+	ep.Subsets[0].Ports = []corev1.EndpointPort{{Name: "web", Port: 9090}}
+	return []client.Object{svc, ep}
+}
+
+func TestExportIngressesRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		ingress *netv1.Ingress
+		objs    []client.Object
+	}{
+		{
+			name:    "port differs from target port",
+			ingress: testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"})),
+		},
+		{
+			name: "named target port",
+			ingress: func() *netv1.Ingress {
+				ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "named"}))
+				ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Port.Number = 8000
+				return ingress
+			}(),
+			objs: testNamedPortBackend("named", "10.0.3.1", "10.0.3.2"),
+		},
+		{
+			name: "tls and plain hosts",
+			ingress: func() *netv1.Ingress {
+				ingress := testIngress("web", nil,
+					testRule("a.example.com", map[string]string{"/": "web"}),
+					testRule("b.example.com", map[string]string{"/": "api"}))
+				ingress.Spec.TLS = []netv1.IngressTLS{{Hosts: []string{"a.example.com"}}}
+				return ingress
+			}(),
+		},
+		{
+			name: "annotations",
+			ingress: testIngress("web", map[string]string{pkg.SecurityAnnotation: "e2e", pkg.EpSelectAnnotation: "hash"},
+				testRule("a.example.com", map[string]string{"/": "web"})),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			r, lb := newTestReconciler(t, testFixtures(append(tt.objs, tt.ingress)...)...)
+			reconcileIngress(t, r, tt.ingress.Name)
+			programmed, _ := lb.List(ctx)
+
+			exported, warnings, err := ExportIngresses(ctx, r.Client, programmed.Item, "", []string{testExternalIP})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(exported) != 1 || len(warnings) != 0 {
+				t.Fatalf("exported %d ingresses with warnings %q, want one without", len(exported), warnings)
+			}
+
+			// the exported Ingress carries no class, like an Ingress relying on the default one
+			reimported := exported[0].DeepCopy()
+			reimported.Spec.IngressClassName = tt.ingress.Spec.IngressClassName
+			r2, lb2 := newTestReconciler(t, testFixtures(append(tt.objs, reimported)...)...)
+			reconcileIngress(t, r2, reimported.Name)
+
+			want, _ := lb.List(ctx)
+			got, _ := lb2.List(ctx)
+			if fmt.Sprint(got.Item) != fmt.Sprint(want.Item) {
+				t.Errorf("re-imported rules = %v, want %v", got.Item, want.Item)
+			}
+		})
+	}
+}
+
+func TestExportIngressesWarnings(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantRules   int
+		wantWarning string
+	}{
+		{
+			name:        "frontend port",
+			annotations: map[string]string{pkg.FrontendPortAnnotation: "8000"},
+			wantRules:   1,
+			wantWarning: pkg.FrontendPortAnnotation,
+		},
+		{
+			name:        "external ip",
+			annotations: map[string]string{pkg.ExternalIPAnnotation: "10.10.10.2"},
+			wantRules:   1,
+			wantWarning: pkg.ExternalIPAnnotation,
+		},
+		{
+			name:        "dual stack",
+			annotations: map[string]string{pkg.IPFamilyAnnotation: "dual"},
+			wantRules:   1,
+			wantWarning: pkg.IPFamilyAnnotation,
+		},
+		{
+			name:        "force l4",
+			annotations: map[string]string{pkg.ForceL4Annotation: "true"},
+			wantWarning: pkg.ForceL4Annotation,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			ingress := testIngress("web", tt.annotations, testRule("a.example.com", map[string]string{"/": "web"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			r.ExternalIPv6 = "fd00::1"
+			reconcileIngress(t, r, ingress.Name)
+			programmed, _ := lb.List(ctx)
+
+			exported, warnings, err := ExportIngresses(ctx, r.Client, programmed.Item, "", []string{testExternalIP, r.ExternalIPv6})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rules := 0
+			for _, ingress := range exported {
+				rules += len(ingress.Spec.Rules)
+			}
+			if rules != tt.wantRules {
+				t.Errorf("exported %d rules, want %d", rules, tt.wantRules)
+			}
+			if len(warnings) != 1 || !strings.Contains(warnings[0], tt.wantWarning) {
+				t.Errorf("warnings = %q, want one about %s", warnings, tt.wantWarning)
+			}
+		})
+	}
+}
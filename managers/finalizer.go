@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+	"time"
+
+	netv1 "k8s.io/api/networking/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// DefaultFinalizer holds the deletion of a programmed Ingress until its loxilb rules are deleted.
+const DefaultFinalizer = "loxilb.io/ingress-cleanup"
+
+// ensureFinalizer adds the cleanup finalizer to ingress, unless finalizers are disabled. A
+// DefaultFinalizer left by an earlier run is removed when another finalizer, or none, is used.
+func (r *LoxilbIngressReconciler) ensureFinalizer(ctx context.Context, ingress *netv1.Ingress) error {
+	stale := r.Finalizer != DefaultFinalizer && controllerutil.ContainsFinalizer(ingress, DefaultFinalizer)
+	missing := r.Finalizer != "" && !controllerutil.ContainsFinalizer(ingress, r.Finalizer)
+	if !stale && !missing {
+		return nil
+	}
+
+	patch := client.MergeFromWithOptions(ingress.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	if stale {
+		controllerutil.RemoveFinalizer(ingress, DefaultFinalizer)
+	}
+	if missing {
+		controllerutil.AddFinalizer(ingress, r.Finalizer)
+	}
+	return r.Client.Patch(ctx, ingress, patch)
+}
+
+// hasCleanupFinalizer reports whether ingress carries the configured finalizer or
+// DefaultFinalizer, which Ingresses keep from earlier runs with the default.
+func (r *LoxilbIngressReconciler) hasCleanupFinalizer(ingress *netv1.Ingress) bool {
+	return controllerutil.ContainsFinalizer(ingress, DefaultFinalizer) ||
+		(r.Finalizer != "" && controllerutil.ContainsFinalizer(ingress, r.Finalizer))
+}
+
+// removeCleanupFinalizers removes the configured finalizer and DefaultFinalizer from ingress.
+func (r *LoxilbIngressReconciler) removeCleanupFinalizers(ctx context.Context, ingress *netv1.Ingress) error {
+	if !r.hasCleanupFinalizer(ingress) {
+		return nil
+	}
+
+	patch := client.MergeFromWithOptions(ingress.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	controllerutil.RemoveFinalizer(ingress, DefaultFinalizer)
+	if r.Finalizer != "" {
+		controllerutil.RemoveFinalizer(ingress, r.Finalizer)
+	}
+	return r.Client.Patch(ctx, ingress, patch)
+}
+
+// finalizeIngress deletes the loxilb rules of an Ingress being deleted, then releases it by
+// removing the cleanup finalizers, even when finalizers are now disabled or renamed.
+// Ingresses without them are cleaned up once they are gone.
+func (r *LoxilbIngressReconciler) finalizeIngress(ctx context.Context, ingress *netv1.Ingress) (ctrl.Result, error) {
+	if !r.hasCleanupFinalizer(ingress) {
+		return ctrl.Result{}, nil
+	}
+
+	if grace := r.deletionGraceRemaining(ingress.DeletionTimestamp.Time); grace > 0 {
+		log.FromContext(ctx).V(1).Info("keep loxilb rules during deletion grace period",
+			"Ingress", client.ObjectKeyFromObject(ingress), "remaining", grace)
+		return ctrl.Result{RequeueAfter: grace}, nil
+	}
+
+	if err := r.deleteIngressLoxiModels(ctx, client.ObjectKeyFromObject(ingress)); err != nil {
+		if requeue, isok := r.getLoxiThrottleRequeue(err); isok {
+			return ctrl.Result{RequeueAfter: requeue}, nil
+		}
+		log.FromContext(ctx).Error(err, "failed to delete loxilb-ingress rule "+r.getLoxiRuleName(ingress.Namespace, ingress.Name))
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, r.removeCleanupFinalizers(ctx, ingress)
+}
+
+// deletionGraceRemaining returns how much longer the rules of an Ingress deleted at
+// deletedAt are kept serving.
+func (r *LoxilbIngressReconciler) deletionGraceRemaining(deletedAt time.Time) time.Duration {
+	if r.DeletionGracePeriod <= 0 {
+		return 0
+	}
+	return time.Until(deletedAt.Add(r.DeletionGracePeriod))
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// loxiCallHealthMinCalls is the number of calls in the window below which the success
+// rate is not judged, so that a single early failure does not flip the health state.
+const loxiCallHealthMinCalls = 10
+
+type loxiCallResult struct {
+	at time.Time
+	ok bool
+}
+
+// loxiCallHealth tracks the outcome of the loxilb API calls of a recent time window.
+type loxiCallHealth struct {
+	mu      sync.Mutex
+	results []loxiCallResult
+}
+
+func (h *loxiCallHealth) record(ok bool, window time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.prune(window)
+	h.results = append(h.results, loxiCallResult{at: time.Now(), ok: ok})
+}
+
+// prune drops the results older than window. h.mu must be held.
+func (h *loxiCallHealth) prune(window time.Duration) {
+	since := time.Now().Add(-window)
+	first := 0
+	for first < len(h.results) && h.results[first].at.Before(since) {
+		first++
+	}
+	h.results = h.results[first:]
+}
+
+// successRate returns the fraction of successful calls within window and the number of calls.
+func (h *loxiCallHealth) successRate(window time.Duration) (float64, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.prune(window)
+
+	if len(h.results) == 0 {
+		return 1, 0
+	}
+	succeeded := 0
+	for _, result := range h.results {
+		if result.ok {
+			succeeded++
+		}
+	}
+	return float64(succeeded) / float64(len(h.results)), len(h.results)
+}
+
+// recordLoxiCall records the outcome of a loxilb API call for the health check and the
+// circuit breaker, when enabled.
+func (r *LoxilbIngressReconciler) recordLoxiCall(err error) {
+	if r.HealthThreshold > 0 {
+		r.callHealth.record(err == nil, r.HealthWindow)
+	}
+	if r.BreakerThreshold > 0 && r.breaker.record(err == nil, r.BreakerThreshold) {
+		if err != nil {
+			log.Log.WithName("circuit-breaker").Info("loxilb circuit breaker opened", "failures", r.BreakerThreshold, "cooldown", r.BreakerCooldown)
+		} else {
+			log.Log.WithName("circuit-breaker").Info("loxilb circuit breaker closed")
+		}
+	}
+}
+
+// checkLoxiCallHealth is a health check failing when the success rate of loxilb API calls
+// over HealthWindow drops below HealthThreshold, so that a loxilb outage is visible to the
+// orchestrator.
+func (r *LoxilbIngressReconciler) checkLoxiCallHealth(_ *http.Request) error {
+	rate, calls := r.callHealth.successRate(r.HealthWindow)
+	if calls < loxiCallHealthMinCalls || rate >= r.HealthThreshold {
+		return nil
+	}
+	return fmt.Errorf("loxilb API success rate %.2f over the last %s is below %.2f", rate, r.HealthWindow, r.HealthThreshold)
+}
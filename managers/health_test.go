@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	loxiapi "github.com/loxilb-io/kube-loxilb/pkg/api"
+)
+
+func TestLoxiCallHealth(t *testing.T) {
+	tests := []struct {
+		name        string
+		failures    int
+		successes   int
+		aged        bool
+		wantHealthy bool
+	}{
+		{name: "successes", successes: 10, wantHealthy: true},
+		{name: "high failure rate", failures: 6, successes: 4},
+		{name: "failure rate at threshold", failures: 5, successes: 5, wantHealthy: true},
+		{name: "too few calls", failures: loxiCallHealthMinCalls - 1, wantHealthy: true},
+		{name: "failures out of the window", failures: 10, aged: true, wantHealthy: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := &failingLoadBalancerAPI{fakeLoadBalancerAPI: newFakeLoadBalancerAPI(), err: errors.New("connection refused")}
+			r := &LoxilbIngressReconciler{
+				LoadBalancerAPI: lb,
+				HealthWindow:    time.Minute,
+				HealthThreshold: 0.5,
+			}
+
+			ctx := context.Background()
+			for i := 0; i < tt.failures+tt.successes; i++ {
+				if i == tt.failures {
+					lb.err = nil
+				}
+				model := &loxiapi.LoadBalancerModel{Service: loxiapi.LoadBalancerService{ExternalIP: testExternalIP, Port: uint16(i), Protocol: "tcp"}}
+				_ = r.createLoxiModel(ctx, model)
+			}
+			if tt.aged {
+				for i := range r.callHealth.results {
+					r.callHealth.results[i].at = r.callHealth.results[i].at.Add(-r.HealthWindow)
+				}
+			}
+
+			if err := r.checkLoxiCallHealth(nil); (err == nil) != tt.wantHealthy {
+				t.Errorf("health check error = %v, want healthy %t", err, tt.wantHealthy)
+			}
+		})
+	}
+}
@@ -19,27 +19,154 @@ package managers
 import (
 	"context"
 	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"loxilb.io/loxilb-ingress-manager/pkg"
 
 	loxiapi "github.com/loxilb-io/kube-loxilb/pkg/api"
 )
 
+// loxiRateLimitRequeue is how long work refused by the loxilb API rate limit is deferred.
+const loxiRateLimitRequeue = time.Second
+
 type LoxilbIngressReconciler struct {
 	client.Client
 	Scheme     *runtime.Scheme
+	Recorder   record.EventRecorder
 	LoxiClient *loxiapi.LoxiClient
+	// LoadBalancerAPI replaces the API of LoxiClient for the loxilb rules when set, e.g. by
+	// a fake in tests. LoxiClient still provides the external IP.
+	LoadBalancerAPI LoadBalancerAPI
+	// NamespaceSelector restricts the controller to Ingresses in namespaces whose
+	// labels match. A nil or empty selector matches every namespace.
+	NamespaceSelector labels.Selector
+	// Resolver resolves service DNS names for pkg.EndpointDiscoveryAnnotation. Defaults to net.DefaultResolver.
+	Resolver Resolver
+	// ClusterDomain is the DNS domain of the cluster, e.g. "cluster.local".
+	ClusterDomain string
+	// DNSResyncPeriod is how often Ingresses using DNS endpoint discovery are re-resolved.
+	DNSResyncPeriod time.Duration
+	// InitialSyncTimeout bounds the reconciliation of existing Ingresses at startup.
+	InitialSyncTimeout time.Duration
+	// MigrateBackendAnnotations rewrites Ingresses using the deprecated
+	// pkg.ExternalBackendServiceAnnotation scheme once at startup.
+	MigrateBackendAnnotations bool
+	// LoxiRateLimiter limits the rate of loxilb API calls. Calls beyond it are requeued.
+	LoxiRateLimiter flowcontrol.RateLimiter
+	// CleanupOnShutdown deletes the rules owned by this controller when it stops.
+	CleanupOnShutdown bool
+	// NodeName is the node this controller and its loxilb run on. Backends with
+	// externalTrafficPolicy Local only get the endpoints on this node.
+	NodeName string
+	// MaxRulesPerIngress and MaxEndpointsPerIngress bound the number of loxilb rules and
+	// endpoints one Ingress may generate. Zero means no limit.
+	MaxRulesPerIngress     int
+	MaxEndpointsPerIngress int
+	// IngressClassController is the spec.controller of the IngressClasses this controller
+	// handles. Empty handles every Ingress regardless of its class.
+	IngressClassController string
+	// BackendDebounce delays the reconciles triggered by backend Service and Endpoints
+	// changes until they settled for this long, coalescing bursts of changes into one
+	// reconcile. Zero reconciles at once.
+	BackendDebounce time.Duration
+	// MaxEndpointsPerRule caps the endpoints of each rule to a stable subset of the backend
+	// endpoints. Zero programs every endpoint.
+	MaxEndpointsPerRule int
+	// RequireOptIn only handles Ingresses annotated with loxilb.io/enabled: "true".
+	RequireOptIn bool
+	// NginxCompat translates nginx ingress annotations to their loxilb equivalents.
+	NginxCompat bool
+	// RuleNamePrefix is prepended to the "<namespace>_<name>" names of the loxilb rules, to
+	// tell them apart from the rules of other loxilb tooling. Rules named without it are
+	// migrated to the prefixed name.
+	RuleNamePrefix string
+	// ExternalIPv6 is the IPv6 address of loxilb-ingress, used with LoxiClient.Host by
+	// Ingresses selecting their address family with loxilb.io/ip-family.
+	ExternalIPv6 string
+	// SkipStatusUpdate leaves the status of every Ingress alone, as the
+	// loxilb.io/skip-status-update annotation does for one Ingress.
+	SkipStatusUpdate bool
+	// Finalizer is the finalizer holding Ingress deletion until its rules are deleted.
+	// Empty disables it; rules are then deleted once the Ingress is gone.
+	Finalizer string
+
+	// HealthWindow and HealthThreshold make the readiness check fail when less than
+	// HealthThreshold of the loxilb API calls of the last HealthWindow succeed.
+	// A zero threshold disables the check.
+	HealthWindow    time.Duration
+	HealthThreshold float64
+
+	// BreakerThreshold is the number of consecutive failed loxilb API calls opening the
+	// circuit breaker, which then suspends the calls for BreakerCooldown before probing
+	// loxilb again. Zero disables the breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// DeletionGracePeriod keeps the rules of a deleted Ingress serving for this long, so
+	// in-flight requests can finish. With Finalizer set, the Ingress is held until then, so
+	// it cannot be recreated meanwhile; without, an Ingress recreated meanwhile under the
+	// same name takes its rules back.
+	DeletionGracePeriod time.Duration
+
+	// RetryBudget is the number of retries of failed loxilb updates allowed per first
+	// attempt. Zero disables the budget.
+	RetryBudget float64
+
+	// FullResyncPeriod is how often every Ingress is reprogrammed in full, even when nothing
+	// changed, to repair loxilb rules lost or changed out of band (e.g. a loxilb restart).
+	// Zero only reprograms on changes.
+	FullResyncPeriod time.Duration
+
+	// reconciledVersions holds the resourceVersion of each Ingress last programmed
+	// successfully, with when, and dirtyKeys the Ingresses whose dependent objects changed since.
+	reconciledVersions sync.Map
+	dirtyKeys          sync.Map
+	// pendingDeletions holds when Ingresses deleted without finalizer were found gone.
+	pendingDeletions sync.Map
+	// retries is the retry budget, and failedKeys the Ingresses whose last update failed.
+	retries    retryBudget
+	failedKeys sync.Map
+	// callHealth records the outcome of loxilb API calls.
+	callHealth loxiCallHealth
+	breaker    loxiCircuitBreaker
+	// missingBackends holds when deleted backend services were first found missing.
+	missingBackends sync.Map
+	// migratedRules holds the rule names whose rules named without RuleNamePrefix were migrated.
+	migratedRules sync.Map
+	// debouncer holds the backend requests waiting for their burst to settle.
+	debouncer backendDebouncer
+	// initSync tracks the reconciles of the initial sync.
+	initSync *initialSync
+	// ownedRules holds the names of the loxilb rules programmed by this controller.
+	ownedRules sync.Map
+	// expiredIngresses holds the UID of the Ingresses whose rules expired.
+	expiredIngresses sync.Map
 }
 
 func (r *LoxilbIngressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
+	defer r.initSync.reconciled(req.NamespacedName)
 
 	ingress := &netv1.Ingress{}
 	err := r.Client.Get(ctx, req.NamespacedName, ingress)
@@ -47,10 +174,22 @@ func (r *LoxilbIngressReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		// Ingress is deleted.
 		if errors.IsNotFound(err) {
 			logger.Info("This resource is deleted", "Ingress", req.NamespacedName)
-			ruleName := fmt.Sprintf("%s_%s", req.Namespace, req.Name)
-			if err := r.LoxiClient.LoadBalancer().DeleteByName(ctx, ruleName); err != nil {
-				logger.Error(err, "failed to delete loxilb-ingress rule "+ruleName)
+			r.failedKeys.Delete(req.NamespacedName)
+			r.reconciledVersions.Delete(req.NamespacedName)
+			r.dirtyKeys.Delete(req.NamespacedName)
+			r.expiredIngresses.Delete(req.NamespacedName)
+			deletedAt, _ := r.pendingDeletions.LoadOrStore(req.NamespacedName, time.Now())
+			if grace := r.deletionGraceRemaining(deletedAt.(time.Time)); grace > 0 {
+				logger.V(1).Info("keep loxilb rules during deletion grace period", "Ingress", req.NamespacedName, "remaining", grace)
+				return ctrl.Result{RequeueAfter: grace}, nil
+			}
+			if err := r.deleteIngressLoxiModels(ctx, req.NamespacedName); err != nil {
+				if requeue, isok := r.getLoxiThrottleRequeue(err); isok {
+					return ctrl.Result{RequeueAfter: requeue}, nil
+				}
+				logger.Error(err, "failed to delete loxilb-ingress rule "+r.getLoxiRuleName(req.Namespace, req.Name))
 			}
+			r.pendingDeletions.Delete(req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 
@@ -58,44 +197,278 @@ func (r *LoxilbIngressReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return ctrl.Result{}, err
 	}
 
+	if !ingress.DeletionTimestamp.IsZero() {
+		return r.finalizeIngress(ctx, ingress)
+	}
+	// without finalizer, an Ingress recreated during the deletion grace period of its
+	// predecessor takes back the rules kept for it
+	r.pendingDeletions.Delete(req.NamespacedName)
+
+	selected, err := r.isNamespaceSelected(ctx, ingress.Namespace)
+	if err != nil {
+		// do not unprogram the Ingress over a transient failure, retry instead
+		logger.Error(err, "Failed to get namespace", "namespace", ingress.Namespace)
+		return ctrl.Result{}, err
+	}
+	if !selected {
+		logger.V(1).Info("Ignore ingress in unselected namespace", "Ingress", req.NamespacedName)
+		return r.unprogramIngress(ctx, ingress)
+	}
+
+	if !r.isIngressClassHandled(ctx, ingress) {
+		logger.V(1).Info("Ignore ingress of another ingress class", "Ingress", req.NamespacedName)
+		return r.unprogramIngress(ctx, ingress)
+	}
+
+	if r.RequireOptIn && ingress.Annotations[pkg.EnabledAnnotation] != "true" {
+		logger.V(1).Info("Ignore ingress not opted in", "Ingress", req.NamespacedName)
+		return r.unprogramIngress(ctx, ingress)
+	}
+
+	configured, mappings, err := r.configureIngress(ctx, ingress)
+	if err != nil {
+		r.Recorder.Event(ingress, corev1.EventTypeWarning, "InvalidIngressClassParameters", err.Error())
+		logger.Error(err, "Failed to get ingress class parameters", "ingress", req.NamespacedName)
+		return ctrl.Result{}, err
+	}
+	for _, mapping := range mappings {
+		logger.Info("Apply nginx annotation", "ingress", req.NamespacedName, "mapping", mapping)
+	}
+	ingress = configured
+
+	config, err := pkg.ParseIngressConfig(ingress)
+	if err != nil {
+		r.Recorder.Event(ingress, corev1.EventTypeWarning, "InvalidAnnotation", err.Error())
+		logger.Error(err, "Failed to set ingress. invalid annotations", "ingress", ingress)
+		return ctrl.Result{}, err
+	}
+
+	r.warnOrphanTLSHosts(ingress)
+
+	ruleName := r.getLoxiRuleName(ingress.Namespace, ingress.Name)
+	var expiresIn time.Duration
+	if config.RuleTTL > 0 {
+		expiresIn = time.Until(ingress.CreationTimestamp.Add(config.RuleTTL))
+		if expiresIn <= 0 {
+			return r.expireIngressRules(ctx, ingress, ruleName)
+		}
+	}
+	// a TTL extended or removed after expiry programs the rules again, until they expire again
+	r.expiredIngresses.Delete(req.NamespacedName)
+
+	if r.isIngressUpToDate(ingress, &config) {
+		logger.V(1).Info("Skip unchanged ingress", "ingress", req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+
 	// when ingress is added, install rule to loxilb-ingress
-	models, err := r.createLoxiModelList(ctx, ingress)
+	models, err := r.createLoxiModelList(ctx, ingress, &config)
 	if err != nil {
 		logger.Error(err, "Failed to set ingress. failed to create loxilb loadbalancer model", "ingress", ingress)
+		return ctrl.Result{}, err
+	}
+
+	if err := r.checkIngressLimits(ingress, models); err != nil {
+		logger.Error(err, "Failed to set ingress. too many loxilb rules or endpoints", "ingress", ingress)
+		if err := r.setIngressErrorStatus(ctx, ingress, models, ingressLimitExceededStatusError); err != nil {
+			logger.Error(err, "Failed to update ingress status", "ingress", ingress)
+		}
+		return ctrl.Result{}, err
+	}
+
+	if err := r.ensureFinalizer(ctx, ingress); err != nil {
+		logger.Error(err, "Failed to set ingress. failed to add finalizer", "ingress", ingress)
+		return ctrl.Result{}, err
 	}
 
-	for _, model := range models {
-		err = r.LoxiClient.LoadBalancer().Create(ctx, &model)
-		if err != nil {
-			logger.Error(err, "Failed to set ingress. failed to install loadbalancer rule to loxilb", "ingress", ingress)
+	if !r.acquireRetryBudget(req.NamespacedName) {
+		logger.V(1).Info("loxilb retry budget exhausted, requeue", "ingress", req.NamespacedName)
+		return ctrl.Result{RequeueAfter: retryBudgetRequeue}, nil
+	}
+
+	r.ownedRules.Store(ruleName, struct{}{})
+	summary, err := r.applyLoxiModels(ctx, ruleName, models)
+	if err != nil {
+		if requeue, isok := r.getLoxiThrottleRequeue(err); isok {
+			logger.V(1).Info("loxilb API call refused, requeue", "ingress", req.NamespacedName, "reason", err.Error())
+			return ctrl.Result{RequeueAfter: requeue}, nil
+		}
+		r.failedKeys.Store(req.NamespacedName, struct{}{})
+		logger.Error(err, "Failed to set ingress. failed to install loadbalancer rule to loxilb", "ingress", ingress)
+		return ctrl.Result{}, err
+	}
+	r.failedKeys.Delete(req.NamespacedName)
+	logger.V(1).Info("Applied loxilb rules", "ingress", req.NamespacedName, "created", summary.Created,
+		"updated", summary.Updated, "unchanged", summary.Unchanged, "deleted", summary.Deleted)
+
+	if !r.SkipStatusUpdate && !config.SkipStatusUpdate {
+		if err := r.updateIngressStatus(ctx, ingress, models); err != nil {
+			logger.Error(err, "Failed to update ingress status", "ingress", ingress)
 			return ctrl.Result{}, err
 		}
 	}
+	// the status patch bumped the resourceVersion, so record it only now
+	r.reconciledVersions.Store(req.NamespacedName, reconciledVersion{version: ingress.ResourceVersion, at: time.Now()})
+
+	// nothing watches loxilb, so reprogram it in full periodically
+	result := ctrl.Result{RequeueAfter: r.FullResyncPeriod}
+	// DNS records are not watched, so re-resolve them periodically
+	if config.DNSDiscovery {
+		result.RequeueAfter = r.DNSResyncPeriod
+	}
+	if config.ResyncInterval > 0 && (result.RequeueAfter == 0 || config.ResyncInterval < result.RequeueAfter) {
+		result.RequeueAfter = config.ResyncInterval
+	}
+	if expiresIn > 0 && (result.RequeueAfter == 0 || expiresIn < result.RequeueAfter) {
+		result.RequeueAfter = expiresIn
+	}
+
+	return result, nil
+}
+
+// isIngressProgrammed reports whether this controller programmed rules for ingress: during
+// this run, or in an earlier one that left the cleanup finalizer.
+func (r *LoxilbIngressReconciler) isIngressProgrammed(ingress *netv1.Ingress) bool {
+	if _, isok := r.ownedRules.Load(r.getLoxiRuleName(ingress.Namespace, ingress.Name)); isok {
+		return true
+	}
+	return r.hasCleanupFinalizer(ingress)
+}
+
+// unprogramIngress deletes the rules of an Ingress this controller no longer handles, clears
+// its status and releases its cleanup finalizers. Ingresses that were never programmed are
+// left alone.
+func (r *LoxilbIngressReconciler) unprogramIngress(ctx context.Context, ingress *netv1.Ingress) (ctrl.Result, error) {
+	if !r.isIngressProgrammed(ingress) {
+		return ctrl.Result{}, nil
+	}
+
+	key := client.ObjectKeyFromObject(ingress)
+	if err := r.deleteIngressLoxiModels(ctx, key); err != nil {
+		if requeue, isok := r.getLoxiThrottleRequeue(err); isok {
+			return ctrl.Result{RequeueAfter: requeue}, nil
+		}
+		log.FromContext(ctx).Error(err, "failed to delete loxilb-ingress rule "+r.getLoxiRuleName(ingress.Namespace, ingress.Name))
+		return ctrl.Result{}, err
+	}
+	r.reconciledVersions.Delete(key)
+	r.failedKeys.Delete(key)
+	if err := r.clearIngressStatus(ctx, ingress); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to clear ingress status", "ingress", key)
+		return ctrl.Result{}, err
+	}
 
+	log.FromContext(ctx).Info("Unprogrammed ingress no longer handled", "ingress", key)
+	return ctrl.Result{}, r.removeCleanupFinalizers(ctx, ingress)
+}
+
+// reconciledVersion is the resourceVersion an Ingress was last programmed successfully at.
+type reconciledVersion struct {
+	version string
+	at      time.Time
+}
+
+// isIngressUpToDate reports whether the Ingress is programmed as is: it did not change since
+// its last successful reconcile, less than FullResyncPeriod ago, and neither did the objects
+// it depends on. Ingresses relying on periodic reconciles (DNS discovery, resync interval,
+// rule TTL) are never skipped.
+func (r *LoxilbIngressReconciler) isIngressUpToDate(ingress *netv1.Ingress, config *pkg.IngressConfig) bool {
+	key := client.ObjectKeyFromObject(ingress)
+	_, isDirty := r.dirtyKeys.LoadAndDelete(key)
+	if isDirty || config.DNSDiscovery || config.ResyncInterval > 0 || config.RuleTTL > 0 {
+		r.reconciledVersions.Delete(key)
+		return false
+	}
+
+	value, isok := r.reconciledVersions.Load(key)
+	if isok {
+		version := value.(reconciledVersion)
+		if version.version == ingress.ResourceVersion &&
+			(r.FullResyncPeriod <= 0 || time.Since(version.at) < r.FullResyncPeriod) {
+			return true
+		}
+	}
+	// forget the version until this reconcile succeeds, so that a failure is retried in full
+	r.reconciledVersions.Delete(key)
+	return false
+}
+
+// configureIngress returns the Ingress as configured: with the nginx annotations mapped when
+// NginxCompat is set, and the defaults of its IngressClass applied. The Ingress is copied
+// when changed. Reconcile, the backend index and the offline validation all parse the
+// annotations of the configured Ingress, so that they agree on its configuration.
+func (r *LoxilbIngressReconciler) configureIngress(ctx context.Context, ingress *netv1.Ingress) (*netv1.Ingress, []string, error) {
+	var mappings []string
+	if r.NginxCompat {
+		ingress = ingress.DeepCopy()
+		ingress.Annotations, mappings = pkg.MapNginxAnnotations(ingress.Annotations)
+	}
+
+	defaults, err := r.getIngressClassDefaults(ctx, ingress)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(defaults) > 0 {
+		ingress = applyIngressClassDefaults(ingress, defaults)
+	}
+	return ingress, mappings, nil
+}
+
+// expireIngressRules deletes the rules of an Ingress whose loxilb.io/rule-ttl has elapsed and
+// clears its status, once per Ingress. The Ingress itself is left alone; it is up to its
+// owner to clean it up.
+func (r *LoxilbIngressReconciler) expireIngressRules(ctx context.Context, ingress *netv1.Ingress, ruleName string) (ctrl.Result, error) {
+	key := client.ObjectKeyFromObject(ingress)
+	if uid, isok := r.expiredIngresses.Load(key); isok && uid == ingress.UID {
+		return ctrl.Result{}, nil
+	}
+
+	if err := r.deleteLoxiModelsByName(ctx, ruleName); err != nil {
+		if requeue, isok := r.getLoxiThrottleRequeue(err); isok {
+			return ctrl.Result{RequeueAfter: requeue}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	r.ownedRules.Delete(ruleName)
+	if err := r.clearIngressStatus(ctx, ingress); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.expiredIngresses.Store(key, ingress.UID)
+
+	log.FromContext(ctx).Info("loxilb rules expired", "name", ruleName)
+	r.Recorder.Event(ingress, corev1.EventTypeNormal, "RuleExpired", "loxilb rules deleted after "+pkg.RuleTTLAnnotation)
 	return ctrl.Result{}, nil
 }
 
-func (r *LoxilbIngressReconciler) createLoxiLoadBalancerService(ns, name, externalIP string, security int32, host string) loxiapi.LoadBalancerService {
+// createLoxiLoadBalancerService returns the rule of host. The security comes from the TLS
+// configuration only; the port is frontendPort, or 80/443 depending on security when zero.
+func (r *LoxilbIngressReconciler) createLoxiLoadBalancerService(ns, name, externalIP string, security int32, host string, frontendPort uint16) loxiapi.LoadBalancerService {
 	service := loxiapi.LoadBalancerService{
 		ExternalIP: externalIP,
 		Protocol:   "tcp",
 		Mode:       4, // fullproxy mode
-		Name:       fmt.Sprintf("%s_%s", ns, name),
+		Name:       r.getLoxiRuleName(ns, name),
 		Host:       host,
 		Security:   security,
 	}
 
-	// when ingress is set TLS, using https port (443)
-	if security == 0 {
+	if frontendPort != 0 {
+		service.Port = frontendPort
+	} else if security == 0 {
 		service.Port = 80
 	} else {
+		// when ingress is set TLS, using https port (443)
 		service.Port = 443
 	}
 
 	return service
 }
 
-func (r *LoxilbIngressReconciler) createLoxiLoadBalancerEndpoints(ctx context.Context, ns, name string, port int32) ([]loxiapi.LoadBalancerEndpoint, error) {
+// createLoxiLoadBalancerEndpoints returns the ready endpoints of a service, and also the
+// not-ready ones when publishNotReady is set. When container is set, the target port of each
+// endpoint is the port of that pod container named like the service's targetPort. Services
+// with externalTrafficPolicy Local only get the endpoints on the node of this controller.
+func (r *LoxilbIngressReconciler) createLoxiLoadBalancerEndpoints(ctx context.Context, ns, name string, port int32, publishNotReady bool, container string) ([]loxiapi.LoadBalancerEndpoint, error) {
 	loxilbEpList := make([]loxiapi.LoadBalancerEndpoint, 0)
 	key := types.NamespacedName{
 		Namespace: ns,
@@ -107,11 +480,47 @@ func (r *LoxilbIngressReconciler) createLoxiLoadBalancerEndpoints(ctx context.Co
 		return loxilbEpList, err
 	}
 
+	localNode, err := r.getLocalTrafficNode(ctx, ns, name)
+	if err != nil {
+		return loxilbEpList, err
+	}
+
+	svcPort, err := r.getServicePort(ctx, ns, name, port)
+	if err != nil {
+		return loxilbEpList, err
+	}
+	portName := ""
+	if svcPort != nil && svcPort.TargetPort.Type == intstr.String {
+		portName = svcPort.TargetPort.StrVal
+	}
+
 	for _, subset := range ep.Subsets {
-		for _, addr := range subset.Addresses {
+		// endpoints carry the targetPort, which may differ from the service port, and a
+		// named targetPort may resolve to different numbers per pod, which the Endpoints
+		// controller splits into subsets carrying the resolved number
+		subsetPort := port
+		if svcPort != nil {
+			subsetPort = getEndpointPort(subset.Ports, svcPort.Name, port)
+		}
+
+		addresses := subset.Addresses
+		if publishNotReady {
+			addresses = append(append([]corev1.EndpointAddress{}, subset.Addresses...), subset.NotReadyAddresses...)
+		}
+
+		for _, addr := range addresses {
+			if localNode != "" && (addr.NodeName == nil || *addr.NodeName != localNode) {
+				continue
+			}
+
+			targetPort := subsetPort
+			if container != "" && portName != "" {
+				targetPort = r.getContainerPort(ctx, &addr, container, portName, subsetPort)
+			}
+
 			loxilbEp := loxiapi.LoadBalancerEndpoint{
 				EndpointIP: addr.IP,
-				TargetPort: uint16(port),
+				TargetPort: uint16(targetPort),
 				Weight:     uint8(1),
 			}
 			loxilbEpList = append(loxilbEpList, loxilbEp)
@@ -121,6 +530,93 @@ func (r *LoxilbIngressReconciler) createLoxiLoadBalancerEndpoints(ctx context.Co
 	return loxilbEpList, nil
 }
 
+// getLocalTrafficNode returns the node whose endpoints service ns/name is restricted to, or
+// an empty string when all endpoints are used: the service does not set
+// externalTrafficPolicy Local, or the node of this controller is unknown.
+func (r *LoxilbIngressReconciler) getLocalTrafficNode(ctx context.Context, ns, name string) (string, error) {
+	if r.NodeName == "" {
+		return "", nil
+	}
+
+	svc := &corev1.Service{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, svc); err != nil {
+		return "", err
+	}
+	if svc.Spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyLocal {
+		return "", nil
+	}
+	return r.NodeName, nil
+}
+
+// getServicePort returns the port of service ns/name numbered port, or nil if it has none.
+func (r *LoxilbIngressReconciler) getServicePort(ctx context.Context, ns, name string, port int32) (*corev1.ServicePort, error) {
+	svc := &corev1.Service{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, svc); err != nil {
+		return nil, err
+	}
+
+	for i := range svc.Spec.Ports {
+		if svc.Spec.Ports[i].Port == port {
+			return &svc.Spec.Ports[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// getEndpointPort returns the number of the endpoint port named after service port
+// svcPortName, or defaultPort if the subset has no such port.
+func getEndpointPort(ports []corev1.EndpointPort, svcPortName string, defaultPort int32) int32 {
+	for _, epPort := range ports {
+		if epPort.Name == svcPortName {
+			return epPort.Port
+		}
+	}
+	return defaultPort
+}
+
+// getContainerPort returns the port named portName of container in the pod behind addr.
+// If the pod or the port cannot be found, defaultPort is returned.
+func (r *LoxilbIngressReconciler) getContainerPort(ctx context.Context, addr *corev1.EndpointAddress, container, portName string, defaultPort int32) int32 {
+	logger := log.FromContext(ctx)
+	if addr.TargetRef == nil || addr.TargetRef.Kind != "Pod" {
+		return defaultPort
+	}
+
+	pod := &corev1.Pod{}
+	key := types.NamespacedName{Namespace: addr.TargetRef.Namespace, Name: addr.TargetRef.Name}
+	if err := r.Client.Get(ctx, key, pod); err != nil {
+		logger.Info("failed to get endpoint pod, using service port", "pod", key, "error", err.Error())
+		return defaultPort
+	}
+
+	for _, c := range pod.Spec.Containers {
+		if c.Name != container {
+			continue
+		}
+		for _, containerPort := range c.Ports {
+			if containerPort.Name == portName {
+				return containerPort.ContainerPort
+			}
+		}
+	}
+
+	logger.Info("container port not found, using service port", "pod", key, "container", container, "port", portName)
+	return defaultPort
+}
+
+// getPublishNotReady reports whether not-ready endpoints of service ns/name are programmed.
+func (r *LoxilbIngressReconciler) getPublishNotReady(ctx context.Context, config *pkg.IngressConfig, ns, name string) (bool, error) {
+	if config.PublishNotReady {
+		return true, nil
+	}
+
+	svc := &corev1.Service{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, svc); err != nil {
+		return false, err
+	}
+	return svc.Spec.PublishNotReadyAddresses, nil
+}
+
 func (r *LoxilbIngressReconciler) checkTlsHost(host string, TLS []netv1.IngressTLS) bool {
 	for _, tls := range TLS {
 		for _, tlsHost := range tls.Hosts {
@@ -132,48 +628,444 @@ func (r *LoxilbIngressReconciler) checkTlsHost(host string, TLS []netv1.IngressT
 	return false
 }
 
-func (r *LoxilbIngressReconciler) getBackendServiceNamespace(ingress *netv1.Ingress, backendName string) string {
-	if _, isok := ingress.Annotations["external-backend-service"]; isok {
-		if backendNamespace, isNs := ingress.Annotations["service-"+backendName+"-namespace"]; isNs {
-			return backendNamespace
+// warnOrphanTLSHosts emits a warning for each spec.tls host that no rule routes, as its
+// TLS configuration has no effect. The rest of the Ingress is programmed as usual.
+func (r *LoxilbIngressReconciler) warnOrphanTLSHosts(ingress *netv1.Ingress) {
+	ruleHosts := make(map[string]struct{}, len(ingress.Spec.Rules))
+	for _, rule := range ingress.Spec.Rules {
+		ruleHosts[rule.Host] = struct{}{}
+	}
+
+	for _, tls := range ingress.Spec.TLS {
+		for _, host := range tls.Hosts {
+			if _, isok := ruleHosts[host]; !isok {
+				r.Recorder.Eventf(ingress, corev1.EventTypeWarning, "OrphanTLSHost",
+					"TLS host %s is not used by any rule", host)
+			}
+		}
+	}
+}
+
+// getSecurity returns the loxilb security of the rule for host. The security annotation
+// takes precedence; otherwise hosts listed in spec.tls are secured with https.
+func (r *LoxilbIngressReconciler) getSecurity(ingress *netv1.Ingress, config *pkg.IngressConfig, host string) int32 {
+	if config.Security != nil {
+		return *config.Security
+	}
+
+	if r.checkTlsHost(host, ingress.Spec.TLS) {
+		return 1
+	}
+	return 0
+}
+
+// getBackendServicePort returns the port number of the backend service, making sure
+// the service actually exposes the port (by number or by name) the Ingress asks for.
+func (r *LoxilbIngressReconciler) getBackendServicePort(ctx context.Context, ingress *netv1.Ingress, ns string, backend *netv1.IngressServiceBackend) (int32, error) {
+	key := types.NamespacedName{
+		Namespace: ns,
+		Name:      backend.Name,
+	}
+
+	svc := &corev1.Service{}
+	if err := r.Client.Get(ctx, key, svc); err != nil {
+		return 0, err
+	}
+
+	for _, svcPort := range svc.Spec.Ports {
+		if backend.Port.Name != "" {
+			if svcPort.Name == backend.Port.Name {
+				return svcPort.Port, nil
+			}
+		} else if svcPort.Port == backend.Port.Number {
+			return svcPort.Port, nil
+		}
+	}
+
+	err := &BackendPortNotFoundError{
+		Namespace: ns,
+		Service:   backend.Name,
+		Port:      backend.Port.Name,
+	}
+	if err.Port == "" {
+		err.Port = strconv.Itoa(int(backend.Port.Number))
+	}
+	r.Recorder.Event(ingress, corev1.EventTypeWarning, "BackendPortNotFound", err.Error())
+	return 0, err
+}
+
+// getMaintenanceBackend returns the maintenance backend of the Ingress. Without an explicit
+// port, the maintenance service is expected to listen on port.
+func (r *LoxilbIngressReconciler) getMaintenanceBackend(config *pkg.IngressConfig, port int32) (*netv1.IngressServiceBackend, bool) {
+	if config.MaintenanceBackend == nil {
+		return nil, false
+	}
+
+	backend := config.MaintenanceBackend.DeepCopy()
+	if backend.Port.Name == "" && backend.Port.Number == 0 {
+		backend.Port.Number = port
+	}
+	return backend, true
+}
+
+// createMaintenanceEndpoints returns the endpoints of the maintenance backend, if the Ingress has one.
+func (r *LoxilbIngressReconciler) createMaintenanceEndpoints(ctx context.Context, ingress *netv1.Ingress, config *pkg.IngressConfig, port int32) ([]loxiapi.LoadBalancerEndpoint, error) {
+	backend, isok := r.getMaintenanceBackend(config, port)
+	if !isok {
+		return nil, nil
+	}
+
+	maintenancePort, err := r.getBackendServicePort(ctx, ingress, ingress.Namespace, backend)
+	if err != nil {
+		return nil, err
+	}
+	publishNotReady, err := r.getPublishNotReady(ctx, config, ingress.Namespace, backend.Name)
+	if err != nil {
+		return nil, err
+	}
+	return r.createLoxiLoadBalancerEndpoints(ctx, ingress.Namespace, backend.Name, maintenancePort, publishNotReady, "")
+}
+
+// getMissingBackendEndpoints returns the endpoints of the paths of the deleted backend
+// service key, as set by the loxilb.io/missing-backend annotation: none for the maintenance
+// backend to take over, or nil to drop the paths. Until then, notFound is returned so the
+// rules stay as last programmed while the reconcile is retried.
+func (r *LoxilbIngressReconciler) getMissingBackendEndpoints(ctx context.Context, ingress *netv1.Ingress, config *pkg.IngressConfig, key types.NamespacedName, notFound error) ([]loxiapi.LoadBalancerEndpoint, error) {
+	if config.MissingBackend == pkg.MissingBackendKeep {
+		return nil, notFound
+	}
+
+	since, _ := r.missingBackends.LoadOrStore(key, time.Now())
+	if time.Since(since.(time.Time)) < config.MissingBackendGrace {
+		log.FromContext(ctx).Info("backend service deleted, keeping rules during grace period", "service", key)
+		return nil, notFound
+	}
+
+	r.Recorder.Eventf(ingress, corev1.EventTypeWarning, "BackendMissing",
+		"service %s was deleted, its paths use missing-backend mode %s", key, config.MissingBackend)
+	if config.MissingBackend == pkg.MissingBackendMaintenance {
+		return []loxiapi.LoadBalancerEndpoint{}, nil
+	}
+	return nil, nil
+}
+
+// getBackendEndpoints returns the endpoints of backend service ns/name, discovered as
+// configured by the Ingress annotations.
+func (r *LoxilbIngressReconciler) getBackendEndpoints(ctx context.Context, config *pkg.IngressConfig, ns, name string, port int32) ([]loxiapi.LoadBalancerEndpoint, error) {
+	switch config.EndpointMode {
+	case pkg.EndpointModeCluster:
+		return r.createClusterIPEndpoints(ctx, ns, name, port)
+	case pkg.EndpointModeLoadBalancer:
+		return r.createLoadBalancerIPEndpoints(ctx, ns, name, port)
+	}
+
+	if config.DNSDiscovery {
+		loxiep, err := r.resolveLoxiLoadBalancerEndpoints(ctx, ns, name, port)
+		if err == nil {
+			return loxiep, nil
+		}
+		log.FromContext(ctx).Info("DNS endpoint discovery failed, using endpoints", "service", ns+"/"+name, "error", err.Error())
+	}
+
+	publishNotReady, err := r.getPublishNotReady(ctx, config, ns, name)
+	if err != nil {
+		return nil, err
+	}
+	return r.createLoxiLoadBalancerEndpoints(ctx, ns, name, port, publishNotReady, config.TargetContainers[name])
+}
+
+// createClusterIPEndpoints returns the ClusterIP of service ns/name as its single endpoint,
+// leaving the balancing over pods to kube-proxy.
+func (r *LoxilbIngressReconciler) createClusterIPEndpoints(ctx context.Context, ns, name string, port int32) ([]loxiapi.LoadBalancerEndpoint, error) {
+	svc := &corev1.Service{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, svc); err != nil {
+		return nil, err
+	}
+
+	if svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == corev1.ClusterIPNone {
+		return nil, fmt.Errorf("service %s/%s has no cluster IP", ns, name)
+	}
+	return []loxiapi.LoadBalancerEndpoint{{
+		EndpointIP: svc.Spec.ClusterIP,
+		TargetPort: uint16(port),
+		Weight:     uint8(1),
+	}}, nil
+}
+
+// createLoadBalancerIPEndpoints returns the external IP of LoadBalancer service ns/name as
+// its single endpoint, to chain this Ingress in front of another load balancer. Until the
+// IP is assigned, an error is returned; the Service watch reconciles once it is.
+func (r *LoxilbIngressReconciler) createLoadBalancerIPEndpoints(ctx context.Context, ns, name string, port int32) ([]loxiapi.LoadBalancerEndpoint, error) {
+	svc := &corev1.Service{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, svc); err != nil {
+		return nil, err
+	}
+
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return nil, fmt.Errorf("service %s/%s is not of type LoadBalancer", ns, name)
+	}
+	for _, lbIngress := range svc.Status.LoadBalancer.Ingress {
+		if lbIngress.IP != "" {
+			return []loxiapi.LoadBalancerEndpoint{{
+				EndpointIP: lbIngress.IP,
+				TargetPort: uint16(port),
+				Weight:     uint8(1),
+			}}, nil
+		}
+	}
+	return nil, fmt.Errorf("service %s/%s has no load balancer IP assigned yet", ns, name)
+}
+
+// getExternalIPs returns the VIPs the rules of an Ingress are programmed on: the
+// loxilb.io/external-ip annotation if set, else the loxilb-ingress addresses of the
+// family the Ingress asks for.
+func (r *LoxilbIngressReconciler) getExternalIPs(config *pkg.IngressConfig) ([]string, error) {
+	if config.ExternalIP != "" {
+		return []string{config.ExternalIP}, nil
+	}
+	if net.ParseIP(r.LoxiClient.Host) == nil {
+		return nil, &InvalidExternalIPError{IP: r.LoxiClient.Host}
+	}
+	if config.IPFamily == pkg.IPFamilyPrimary {
+		return []string{r.LoxiClient.Host}, nil
+	}
+
+	var ipv4, ipv6 string
+	for _, addr := range []string{r.LoxiClient.Host, r.ExternalIPv6} {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			if ipv4 == "" {
+				ipv4 = addr
+			}
+		} else if ipv6 == "" {
+			ipv6 = addr
+		}
+	}
+
+	externalIPs := make([]string, 0, 2)
+	if config.IPFamily == pkg.IPFamilyIPv4 || config.IPFamily == pkg.IPFamilyDual {
+		if ipv4 == "" {
+			return nil, &IPFamilyUnavailableError{Family: "IPv4"}
+		}
+		externalIPs = append(externalIPs, ipv4)
+	}
+	if config.IPFamily == pkg.IPFamilyIPv6 || config.IPFamily == pkg.IPFamilyDual {
+		if ipv6 == "" {
+			return nil, &IPFamilyUnavailableError{Family: "IPv6"}
 		}
+		externalIPs = append(externalIPs, ipv6)
 	}
-	return ingress.Namespace
+	return externalIPs, nil
 }
 
-func (r *LoxilbIngressReconciler) createLoxiModelList(ctx context.Context, ingress *netv1.Ingress) ([]loxiapi.LoadBalancerModel, error) {
+func (r *LoxilbIngressReconciler) createLoxiModelList(ctx context.Context, ingress *netv1.Ingress, config *pkg.IngressConfig) ([]loxiapi.LoadBalancerModel, error) {
 	models := make([]loxiapi.LoadBalancerModel, 0)
+
+	externalIPs, err := r.getExternalIPs(config)
+	if err != nil {
+		r.Recorder.Event(ingress, corev1.EventTypeWarning, "InvalidExternalIP", err.Error())
+		return models, err
+	}
+
+	// A rule without host is programmed with an empty Host, which loxilb treats as
+	// match-all: it only serves requests no host-specific rule on the same port matches.
+	// Its rule key differs from every host rule, so both coexist in the diff.
 	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
 		for _, path := range rule.HTTP.Paths {
 			if path.Backend.Service != nil {
-				name := path.Backend.Service.Name
-				ns := r.getBackendServiceNamespace(ingress, name)
-				port := path.Backend.Service.Port.Number
-				security := int32(0)
-				if r.checkTlsHost(rule.Host, ingress.Spec.TLS) {
-					security = 1
+				backend := config.GetActiveBackend(path.Backend.Service)
+				name := backend.Name
+				ns := config.GetBackendNamespace(ingress.Namespace, name)
+				var loxiep []loxiapi.LoadBalancerEndpoint
+				port, err := r.getBackendServicePort(ctx, ingress, ns, backend)
+				if errors.IsNotFound(err) {
+					port = backend.Port.Number
+					loxiep, err = r.getMissingBackendEndpoints(ctx, ingress, config, types.NamespacedName{Namespace: ns, Name: name}, err)
+					if err != nil {
+						return models, err
+					}
+					if loxiep == nil {
+						continue
+					}
+				} else if err != nil {
+					return models, err
+				} else {
+					r.missingBackends.Delete(types.NamespacedName{Namespace: ns, Name: name})
+					loxiep, err = r.getBackendEndpoints(ctx, config, ns, name, port)
+					if err != nil {
+						return models, err
+					}
 				}
 
-				loxisvc := r.createLoxiLoadBalancerService(ingress.Namespace, ingress.Name, r.LoxiClient.Host, security, rule.Host)
-				loxiep, err := r.createLoxiLoadBalancerEndpoints(ctx, ns, name, port)
-				if err != nil {
-					return models, err
+				// keep the rule up on the maintenance backend while the backend has no endpoints
+				if len(loxiep) == 0 {
+					maintenanceEp, err := r.createMaintenanceEndpoints(ctx, ingress, config, port)
+					if err != nil {
+						return models, err
+					}
+					if len(maintenanceEp) > 0 {
+						log.FromContext(ctx).Info("backend has no endpoints, using maintenance backend", "service", ns+"/"+name)
+						loxiep = maintenanceEp
+					}
 				}
 
-				model := loxiapi.LoadBalancerModel{
-					Service:   loxisvc,
-					Endpoints: loxiep,
+				security := r.getSecurity(ingress, config, rule.Host)
+				for _, externalIP := range externalIPs {
+					loxisvc := r.createLoxiLoadBalancerService(ingress.Namespace, ingress.Name, externalIP, security, rule.Host, config.FrontendPort)
+					loxisvc.Protocol = config.L4Protocol
+					if config.ForceL4 {
+						// the port stays 443 for TLS hosts, whose TLS now passes through to the backends
+						loxisvc.Mode = config.NatMode
+						loxisvc.Host = ""
+						loxisvc.Security = 0
+					}
+					loxisvc.Sel = config.GetEpSelect(name)
+
+					model := loxiapi.LoadBalancerModel{
+						Service:   loxisvc,
+						Endpoints: append([]loxiapi.LoadBalancerEndpoint(nil), loxiep...),
+					}
+					models = append(models, model)
 				}
-				models = append(models, model)
 			}
 		}
 	}
 
-	return models, nil
+	if key, isok := findEpSelectConflict(models); isok {
+		err := &EpSelectConflictError{Rule: key}
+		r.Recorder.Event(ingress, corev1.EventTypeWarning, "EpSelectConflict", err.Error())
+		return models, err
+	}
+
+	return r.subsetLoxiModels(models), nil
+}
+
+// checkIngressLimits refuses Ingresses generating more rules or endpoints than allowed,
+// so that an oversized Ingress cannot flood loxilb.
+func (r *LoxilbIngressReconciler) checkIngressLimits(ingress *netv1.Ingress, models []loxiapi.LoadBalancerModel) error {
+	keys, merged := mergeLoxiModels(models)
+	endpoints := 0
+	for _, model := range merged {
+		endpoints += len(model.Endpoints)
+	}
+
+	var err *IngressLimitExceededError
+	if r.MaxRulesPerIngress > 0 && len(keys) > r.MaxRulesPerIngress {
+		err = &IngressLimitExceededError{Limit: "rules", Count: len(keys), Max: r.MaxRulesPerIngress}
+	} else if r.MaxEndpointsPerIngress > 0 && endpoints > r.MaxEndpointsPerIngress {
+		err = &IngressLimitExceededError{Limit: "endpoints", Count: endpoints, Max: r.MaxEndpointsPerIngress}
+	}
+	if err == nil {
+		return nil
+	}
+
+	r.Recorder.Event(ingress, corev1.EventTypeWarning, "IngressLimitExceeded", err.Error())
+	return err
+}
+
+// isNamespaceSelected reports whether Ingresses of namespace ns should be programmed:
+// the namespace must exist, must not be terminating and must match NamespaceSelector.
+// Failing to get the namespace is returned as an error rather than as not selected.
+func (r *LoxilbIngressReconciler) isNamespaceSelected(ctx context.Context, ns string) (bool, error) {
+	namespace := &corev1.Namespace{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: ns}, namespace); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+
+	if namespace.Status.Phase == corev1.NamespaceTerminating {
+		return false, nil
+	}
+	if r.NamespaceSelector == nil {
+		return true, nil
+	}
+	return r.NamespaceSelector.Matches(labels.Set(namespace.Labels)), nil
 }
 
 func (r *LoxilbIngressReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// Deletions always pass, so that finalizers are released even in terminating or
+	// unselected namespaces, and so do updates of programmed Ingresses, to unprogram them.
+	// on failure, the event passes for Reconcile to retry
+	isSelected := func(obj client.Object) bool {
+		selected, err := r.isNamespaceSelected(context.Background(), obj.GetNamespace())
+		return selected || err != nil
+	}
+	namespaceFilter := predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return !e.Object.GetDeletionTimestamp().IsZero() || isSelected(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if !e.ObjectNew.GetDeletionTimestamp().IsZero() || isSelected(e.ObjectNew) {
+				return true
+			}
+			ingress, isok := e.ObjectNew.(*netv1.Ingress)
+			return isok && r.isIngressProgrammed(ingress)
+		},
+		DeleteFunc: func(event.DeleteEvent) bool {
+			return true
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return isSelected(e.Object)
+		},
+	}
+
+	if r.MigrateBackendAnnotations {
+		if err := mgr.Add(manager.RunnableFunc(r.migrateIngressBackendAnnotations)); err != nil {
+			return err
+		}
+	}
+
+	if r.CleanupOnShutdown {
+		if err := mgr.Add(&shutdownCleanup{reconciler: r}); err != nil {
+			return err
+		}
+	}
+
+	r.initSync = newInitialSync(r, r.InitialSyncTimeout, mgr.Elected())
+	if err := mgr.Add(r.initSync); err != nil {
+		return err
+	}
+	if err := mgr.AddReadyzCheck("initial-sync", r.initSync.Check); err != nil {
+		return err
+	}
+
+	r.retries.ratio = r.RetryBudget
+
+	if r.HealthThreshold > 0 {
+		if err := mgr.AddReadyzCheck("loxilb", r.checkLoxiCallHealth); err != nil {
+			return err
+		}
+	}
+	if r.BreakerThreshold > 0 {
+		if err := mgr.AddReadyzCheck("loxilb-circuit", r.checkLoxiCircuit); err != nil {
+			return err
+		}
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &netv1.Ingress{},
+		backendServiceIndexKey, r.indexIngressBackendServices); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &netv1.Ingress{},
+		ingressClassIndexKey, indexIngressClassName); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&netv1.Ingress{}).
+		For(&netv1.Ingress{}, builder.WithPredicates(namespaceFilter)).
+		WatchesRawSource(r.initSync.Source()).
+		Watches(&corev1.Service{}, r.enqueueDebounced(r.findIngressesForBackend)).
+		Watches(&corev1.Endpoints{}, r.enqueueDebounced(r.findIngressesForBackend)).
+		Watches(&netv1.IngressClass{}, handler.EnqueueRequestsFromMapFunc(r.findIngressesForClass)).
+		// matching a ConfigMap to IngressClass parameters only takes its name, so only the
+		// metadata of ConfigMaps is cached; the parameters themselves are read uncached
+		WatchesMetadata(&corev1.ConfigMap{}, r.enqueueDebounced(r.findIngressesForParameters)).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.findIngressesForNamespace),
+			builder.WithPredicates(predicate.LabelChangedPredicate{})).
 		Complete(r)
 }
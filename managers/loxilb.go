@@ -0,0 +1,463 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	loxiapi "github.com/loxilb-io/kube-loxilb/pkg/api"
+)
+
+// getLoxiRuleName returns the name of the loxilb rules installed for an Ingress.
+func (r *LoxilbIngressReconciler) getLoxiRuleName(ns, name string) string {
+	return r.RuleNamePrefix + getLegacyLoxiRuleName(ns, name)
+}
+
+// getLegacyLoxiRuleName returns the name of the rules of an Ingress without RuleNamePrefix.
+func getLegacyLoxiRuleName(ns, name string) string {
+	return fmt.Sprintf("%s_%s", ns, name)
+}
+
+// getLoxiRuleKey identifies a loxilb rule by the fields loxilb itself uses to tell rules apart.
+func getLoxiRuleKey(svc *loxiapi.LoadBalancerService) string {
+	return fmt.Sprintf("%s|%s|%d|%s", svc.ExternalIP, svc.Protocol, svc.Port, svc.Host)
+}
+
+func getLoxiEndpointKey(ep *loxiapi.LoadBalancerEndpoint) string {
+	return fmt.Sprintf("%s:%d", ep.EndpointIP, ep.TargetPort)
+}
+
+// acquireLoxiToken applies the circuit breaker and the client-side rate limit of loxilb API
+// calls. It returns ErrLoxiCircuitOpen or ErrLoxiRateLimited instead of blocking, so the
+// caller can requeue.
+func (r *LoxilbIngressReconciler) acquireLoxiToken() error {
+	return r.acquireLoxiTokens(1)
+}
+
+// acquireLoxiTokens is acquireLoxiToken for n calls that must all go through once started.
+func (r *LoxilbIngressReconciler) acquireLoxiTokens(n int) error {
+	if r.LoxiRateLimiter != nil {
+		for i := 0; i < n; i++ {
+			if !r.LoxiRateLimiter.TryAccept() {
+				return ErrLoxiRateLimited
+			}
+		}
+	}
+	// checked last, as a probe let through must be followed by a call recording its outcome
+	if r.BreakerThreshold > 0 && !r.breaker.allow(r.BreakerCooldown) {
+		return ErrLoxiCircuitOpen
+	}
+	return nil
+}
+
+// LoadBalancerAPI is the part of the loxilb load balancer API the reconciler calls, as
+// implemented by the LoadBalancer() of a loxiapi.LoxiClient.
+type LoadBalancerAPI interface {
+	List(ctx context.Context) (*loxiapi.LoadBalancerListModel, error)
+	Create(ctx context.Context, obj loxiapi.LoxiModel) error
+	Delete(ctx context.Context, obj loxiapi.LoxiModel) error
+	DeleteByName(ctx context.Context, name string) error
+}
+
+// loadBalancerAPI returns LoadBalancerAPI when set, else the API of LoxiClient.
+func (r *LoxilbIngressReconciler) loadBalancerAPI() LoadBalancerAPI {
+	if r.LoadBalancerAPI != nil {
+		return r.LoadBalancerAPI
+	}
+	return r.LoxiClient.LoadBalancer()
+}
+
+// The methods below are the only places calling the loxilb API.
+
+func (r *LoxilbIngressReconciler) createLoxiModel(ctx context.Context, model *loxiapi.LoadBalancerModel) error {
+	if err := r.acquireLoxiToken(); err != nil {
+		return err
+	}
+	err := r.loadBalancerAPI().Create(ctx, model)
+	r.recordLoxiCall(err)
+	return err
+}
+
+// replaceLoxiModel deletes current and creates desired in its place. Both tokens are taken
+// up front, so that a refused create cannot leave the rule deleted until the requeue.
+func (r *LoxilbIngressReconciler) replaceLoxiModel(ctx context.Context, current, desired *loxiapi.LoadBalancerModel) error {
+	if err := r.acquireLoxiTokens(2); err != nil {
+		return err
+	}
+	err := r.loadBalancerAPI().Delete(ctx, current)
+	r.recordLoxiCall(err)
+	if err != nil {
+		return err
+	}
+	err = r.loadBalancerAPI().Create(ctx, desired)
+	r.recordLoxiCall(err)
+	return err
+}
+
+func (r *LoxilbIngressReconciler) deleteLoxiModel(ctx context.Context, model *loxiapi.LoadBalancerModel) error {
+	if err := r.acquireLoxiToken(); err != nil {
+		return err
+	}
+	err := r.loadBalancerAPI().Delete(ctx, model)
+	r.recordLoxiCall(err)
+	return err
+}
+
+func (r *LoxilbIngressReconciler) deleteLoxiModelsByName(ctx context.Context, ruleName string) error {
+	if err := r.acquireLoxiToken(); err != nil {
+		return err
+	}
+	err := r.loadBalancerAPI().DeleteByName(ctx, ruleName)
+	r.recordLoxiCall(err)
+	return err
+}
+
+// listAllLoxiModels returns every rule installed in loxilb. The loxilb API
+// (GET /config/loadbalancer/all) is not paginated and returns all rules in one response,
+// so the diff and existence checks built on it see the complete rule set.
+func (r *LoxilbIngressReconciler) listAllLoxiModels(ctx context.Context) ([]loxiapi.LoadBalancerModel, error) {
+	if err := r.acquireLoxiToken(); err != nil {
+		return nil, err
+	}
+
+	lbList, err := r.loadBalancerAPI().List(ctx)
+	r.recordLoxiCall(err)
+	if err != nil {
+		return nil, err
+	}
+	return lbList.Item, nil
+}
+
+// listLoxiModels returns the rules named one of ruleNames that are currently installed in loxilb.
+func (r *LoxilbIngressReconciler) listLoxiModels(ctx context.Context, ruleNames ...string) ([]loxiapi.LoadBalancerModel, error) {
+	allModels, err := r.listAllLoxiModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	models := make([]loxiapi.LoadBalancerModel, 0)
+	for _, model := range allModels {
+		if slices.Contains(ruleNames, model.Service.Name) {
+			models = append(models, model)
+		}
+	}
+	return models, nil
+}
+
+// deleteIngressLoxiModels deletes the rules of the Ingress key, including those still named
+// without RuleNamePrefix.
+func (r *LoxilbIngressReconciler) deleteIngressLoxiModels(ctx context.Context, key types.NamespacedName) error {
+	ruleName := r.getLoxiRuleName(key.Namespace, key.Name)
+	if err := r.deleteLoxiModelsByName(ctx, ruleName); err != nil {
+		return err
+	}
+	r.ownedRules.Delete(ruleName)
+	if legacyName, isok := r.getLegacyLoxiRuleNameToMigrate(ruleName); isok {
+		if err := r.deleteLoxiModelsByName(ctx, legacyName); err != nil {
+			return err
+		}
+	}
+	r.migratedRules.Delete(ruleName)
+	return nil
+}
+
+// getLegacyLoxiRuleNameToMigrate returns the name without RuleNamePrefix of the rules named
+// ruleName, when rules may still be named so: RuleNamePrefix is set, and applyLoxiModels did
+// not migrate them yet.
+func (r *LoxilbIngressReconciler) getLegacyLoxiRuleNameToMigrate(ruleName string) (string, bool) {
+	if r.RuleNamePrefix == "" {
+		return "", false
+	}
+	if _, isok := r.migratedRules.Load(ruleName); isok {
+		return "", false
+	}
+	return strings.TrimPrefix(ruleName, r.RuleNamePrefix), true
+}
+
+// findEpSelectConflict returns the key of a rule that models program with different endpoint
+// selections, if any. mergeLoxiModels would silently keep the first one.
+func findEpSelectConflict(models []loxiapi.LoadBalancerModel) (string, bool) {
+	sels := make(map[string]loxiapi.EpSelect, len(models))
+	for i := range models {
+		key := getLoxiRuleKey(&models[i].Service)
+		if sel, isok := sels[key]; isok && sel != models[i].Service.Sel {
+			return key, true
+		}
+		sels[key] = models[i].Service.Sel
+	}
+	return "", false
+}
+
+// mergeLoxiModels folds models that resolve to the same loxilb rule (e.g. several paths of
+// one host) into a single model carrying the union of their endpoints.
+func mergeLoxiModels(models []loxiapi.LoadBalancerModel) ([]string, map[string]*loxiapi.LoadBalancerModel) {
+	keys := make([]string, 0, len(models))
+	merged := make(map[string]*loxiapi.LoadBalancerModel, len(models))
+	for i := range models {
+		key := getLoxiRuleKey(&models[i].Service)
+		model, isok := merged[key]
+		if !isok {
+			model = &loxiapi.LoadBalancerModel{Service: models[i].Service}
+			merged[key] = model
+			keys = append(keys, key)
+		}
+
+		for _, ep := range models[i].Endpoints {
+			if !hasLoxiEndpoint(model.Endpoints, &ep) {
+				model.Endpoints = append(model.Endpoints, ep)
+			}
+		}
+	}
+	return keys, merged
+}
+
+// subsetLoxiModels merges the models of the paths sharing a rule, and caps the endpoints of
+// each merged rule to a stable subset of MaxEndpointsPerRule endpoints. Subsetting the paths
+// before merging them would let a rule grow past the cap with each path.
+func (r *LoxilbIngressReconciler) subsetLoxiModels(models []loxiapi.LoadBalancerModel) []loxiapi.LoadBalancerModel {
+	keys, merged := mergeLoxiModels(models)
+	subset := make([]loxiapi.LoadBalancerModel, 0, len(keys))
+	for _, key := range keys {
+		model := merged[key]
+		// spread rules over different subsets by seeding with the rule key
+		model.Endpoints = subsetLoxiEndpoints(key, model.Endpoints, r.MaxEndpointsPerRule)
+		// hash selections map clients by endpoint position, so keep the order stable
+		sortLoxiEndpoints(model.Endpoints)
+		subset = append(subset, *model)
+	}
+	return subset
+}
+
+func hasLoxiEndpoint(eps []loxiapi.LoadBalancerEndpoint, ep *loxiapi.LoadBalancerEndpoint) bool {
+	key := getLoxiEndpointKey(ep)
+	for i := range eps {
+		if getLoxiEndpointKey(&eps[i]) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// subsetLoxiEndpoints returns at most n endpoints of eps, picked by rendezvous hashing
+// with seed. The subset is deterministic and stable: adding or removing an endpoint changes
+// at most one member of the subset, so it does not churn between reconciles.
+func subsetLoxiEndpoints(seed string, eps []loxiapi.LoadBalancerEndpoint, n int) []loxiapi.LoadBalancerEndpoint {
+	if n <= 0 || len(eps) <= n {
+		return eps
+	}
+
+	scores := make(map[string]uint64, len(eps))
+	for i := range eps {
+		h := fnv.New64a()
+		h.Write([]byte(seed + "|" + getLoxiEndpointKey(&eps[i])))
+		scores[getLoxiEndpointKey(&eps[i])] = h.Sum64()
+	}
+
+	subset := append([]loxiapi.LoadBalancerEndpoint{}, eps...)
+	sort.SliceStable(subset, func(i, j int) bool {
+		return scores[getLoxiEndpointKey(&subset[i])] > scores[getLoxiEndpointKey(&subset[j])]
+	})
+	return subset[:n]
+}
+
+// sortLoxiEndpoints orders eps by IP address and port, independently of the order the
+// Endpoints object or DNS listed them in.
+func sortLoxiEndpoints(eps []loxiapi.LoadBalancerEndpoint) {
+	sort.SliceStable(eps, func(i, j int) bool {
+		ipi, ipj := net.ParseIP(eps[i].EndpointIP), net.ParseIP(eps[j].EndpointIP)
+		if cmp := bytes.Compare(ipi.To16(), ipj.To16()); cmp != 0 {
+			return cmp < 0
+		}
+		return eps[i].TargetPort < eps[j].TargetPort
+	})
+}
+
+// diffLoxiEndpoints returns the endpoints of desired missing from current and
+// the endpoints of current that are no longer in desired.
+func diffLoxiEndpoints(current, desired []loxiapi.LoadBalancerEndpoint) ([]loxiapi.LoadBalancerEndpoint, []loxiapi.LoadBalancerEndpoint) {
+	added := make([]loxiapi.LoadBalancerEndpoint, 0)
+	for _, ep := range desired {
+		if !hasLoxiEndpoint(current, &ep) {
+			added = append(added, ep)
+		}
+	}
+
+	removed := make([]loxiapi.LoadBalancerEndpoint, 0)
+	for _, ep := range current {
+		if !hasLoxiEndpoint(desired, &ep) {
+			removed = append(removed, ep)
+		}
+	}
+	return added, removed
+}
+
+// isLoxiServiceDrifted reports whether the rule installed in loxilb differs from the desired
+// rule with the same key in its endpoint selection, mode, security or name, e.g. after an
+// out-of-band change, an annotation edit or a RuleNamePrefix change.
+func isLoxiServiceDrifted(current, desired *loxiapi.LoadBalancerService) bool {
+	return current.Sel != desired.Sel || current.Mode != desired.Mode || current.Security != desired.Security ||
+		current.Name != desired.Name
+}
+
+// removeDuplicateLoxiModels indexes current by rule key. If loxilb reports several rules
+// for one key (e.g. after racing creates), the rule is deleted and left out of the index,
+// so that applyLoxiModels recreates it as a single canonical rule.
+func (r *LoxilbIngressReconciler) removeDuplicateLoxiModels(ctx context.Context, ruleName string, current []loxiapi.LoadBalancerModel) (map[string]*loxiapi.LoadBalancerModel, error) {
+	logger := log.FromContext(ctx)
+
+	currentByKey := make(map[string]*loxiapi.LoadBalancerModel, len(current))
+	duplicates := make(map[string]int)
+	for i := range current {
+		key := getLoxiRuleKey(&current[i].Service)
+		if _, isok := currentByKey[key]; isok {
+			duplicates[key]++
+			continue
+		}
+		currentByKey[key] = &current[i]
+	}
+
+	for key, count := range duplicates {
+		logger.Info("delete duplicate loxilb rules", "name", ruleName, "rule", key, "duplicates", count)
+		if err := r.deleteLoxiModel(ctx, currentByKey[key]); err != nil {
+			return nil, err
+		}
+		delete(currentByKey, key)
+	}
+	return currentByKey, nil
+}
+
+// loxiApplySummary lists, by rule key, what applyLoxiModels did to the rules of an Ingress.
+type loxiApplySummary struct {
+	// Created are the rules created from scratch.
+	Created []string
+	// Updated are the existing rules whose endpoints were attached or detached, or that
+	// were replaced because their settings drifted.
+	Updated []string
+	// Unchanged are the existing rules that already matched and were skipped.
+	Unchanged []string
+	// Deleted are the stale or duplicate rules deleted.
+	Deleted []string
+}
+
+// applyLoxiModels installs models as the rules named ruleName in loxilb, make-before-break:
+// new rules and endpoints are added first, and only then are stale endpoints detached and
+// stale rules deleted. This way a rule never runs without endpoints while its backend changes,
+// and a rule moving to another external IP serves on the new VIP before the old one is removed.
+// The exception is a rule whose settings drifted: loxilb cannot hold two rules with the same
+// key, so it is deleted and recreated, and does not serve in between.
+func (r *LoxilbIngressReconciler) applyLoxiModels(ctx context.Context, ruleName string, models []loxiapi.LoadBalancerModel) (loxiApplySummary, error) {
+	logger := log.FromContext(ctx)
+	summary := loxiApplySummary{}
+
+	// rules still named without RuleNamePrefix are taken over like current rules: renamed
+	// (replaced) when still desired, else deleted once the desired rules are in place
+	ruleNames := []string{ruleName}
+	legacyName, migrating := r.getLegacyLoxiRuleNameToMigrate(ruleName)
+	if migrating {
+		ruleNames = append(ruleNames, legacyName)
+	}
+	current, err := r.listLoxiModels(ctx, ruleNames...)
+	if err != nil {
+		return summary, err
+	}
+
+	currentByKey, err := r.removeDuplicateLoxiModels(ctx, ruleName, current)
+	if err != nil {
+		return summary, err
+	}
+	for i := range current {
+		key := getLoxiRuleKey(&current[i].Service)
+		if _, isok := currentByKey[key]; !isok && !slices.Contains(summary.Deleted, key) {
+			summary.Deleted = append(summary.Deleted, key)
+		}
+	}
+
+	keys, desired := mergeLoxiModels(models)
+	detachModels := make([]loxiapi.LoadBalancerModel, 0)
+	for _, key := range keys {
+		model := desired[key]
+		currentModel, isok := currentByKey[key]
+		if !isok {
+			if err := r.createLoxiModel(ctx, model); err != nil {
+				return summary, err
+			}
+			summary.Created = append(summary.Created, key)
+			continue
+		}
+
+		// settings outside the rule key cannot be updated in place, so replace the rule
+		if isLoxiServiceDrifted(&currentModel.Service, &model.Service) {
+			logger.Info("replace drifted loxilb rule", "name", ruleName, "rule", key)
+			if err := r.replaceLoxiModel(ctx, currentModel, model); err != nil {
+				return summary, err
+			}
+			summary.Updated = append(summary.Updated, key)
+			continue
+		}
+
+		added, removed := diffLoxiEndpoints(currentModel.Endpoints, model.Endpoints)
+		if len(added) == 0 && len(removed) == 0 {
+			summary.Unchanged = append(summary.Unchanged, key)
+			continue
+		}
+		if len(added) > 0 {
+			attachModel := loxiapi.LoadBalancerModel{Service: model.Service, Endpoints: added}
+			attachModel.Service.Oper = loxiapi.LBOPAttach
+			if err := r.createLoxiModel(ctx, &attachModel); err != nil {
+				return summary, err
+			}
+		}
+		if len(removed) > 0 {
+			detachModel := loxiapi.LoadBalancerModel{Service: model.Service, Endpoints: removed}
+			detachModel.Service.Oper = loxiapi.LBOPDetach
+			detachModels = append(detachModels, detachModel)
+		}
+		summary.Updated = append(summary.Updated, key)
+	}
+
+	for i := range detachModels {
+		if err := r.createLoxiModel(ctx, &detachModels[i]); err != nil {
+			return summary, err
+		}
+	}
+
+	for key, currentModel := range currentByKey {
+		if _, isok := desired[key]; isok {
+			continue
+		}
+		logger.Info("delete stale loxilb rule", "name", currentModel.Service.Name, "rule", key)
+		if err := r.deleteLoxiModel(ctx, currentModel); err != nil {
+			return summary, err
+		}
+		summary.Deleted = append(summary.Deleted, key)
+	}
+
+	if migrating {
+		r.migratedRules.Store(ruleName, struct{}{})
+	}
+	return summary, nil
+}
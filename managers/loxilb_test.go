@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"fmt"
+	"testing"
+
+	loxiapi "github.com/loxilb-io/kube-loxilb/pkg/api"
+)
+
+func testLoxiEndpoints(n int) []loxiapi.LoadBalancerEndpoint {
+	eps := make([]loxiapi.LoadBalancerEndpoint, 0, n)
+	for i := 0; i < n; i++ {
+		eps = append(eps, loxiapi.LoadBalancerEndpoint{EndpointIP: fmt.Sprintf("10.0.%d.%d", i/250, i%250+1), TargetPort: 8080, Weight: 1})
+	}
+	return eps
+}
+
+// subsetKeys returns the endpoint keys of a subset, as a set.
+func subsetKeys(eps []loxiapi.LoadBalancerEndpoint) map[string]struct{} {
+	keys := make(map[string]struct{}, len(eps))
+	for i := range eps {
+		keys[getLoxiEndpointKey(&eps[i])] = struct{}{}
+	}
+	return keys
+}
+
+// subsetChanges returns how many members of subset a are not in subset b.
+func subsetChanges(a, b []loxiapi.LoadBalancerEndpoint) int {
+	bKeys := subsetKeys(b)
+	changes := 0
+	for key := range subsetKeys(a) {
+		if _, isok := bKeys[key]; !isok {
+			changes++
+		}
+	}
+	return changes
+}
+
+func TestSubsetLoxiEndpointsWithinLimit(t *testing.T) {
+	eps := testLoxiEndpoints(5)
+	for _, n := range []int{0, 5, 10} {
+		if subset := subsetLoxiEndpoints("rule", eps, n); len(subset) != len(eps) {
+			t.Errorf("subset of %d = %d endpoints, want all %d", n, len(subset), len(eps))
+		}
+	}
+}
+
+func TestSubsetLoxiEndpointsIsDeterministic(t *testing.T) {
+	eps := testLoxiEndpoints(50)
+	subset := subsetLoxiEndpoints("rule", eps, 10)
+	if len(subset) != 10 {
+		t.Fatalf("subset = %d endpoints, want 10", len(subset))
+	}
+
+	reversed := make([]loxiapi.LoadBalancerEndpoint, 0, len(eps))
+	for i := len(eps) - 1; i >= 0; i-- {
+		reversed = append(reversed, eps[i])
+	}
+	if changes := subsetChanges(subset, subsetLoxiEndpoints("rule", reversed, 10)); changes != 0 {
+		t.Errorf("subset of reordered endpoints changed %d members, want none", changes)
+	}
+	if changes := subsetChanges(subset, subsetLoxiEndpoints("other-rule", eps, 10)); changes == 0 {
+		t.Errorf("subsets of two rules are equal, want them spread by seed")
+	}
+}
+
+func TestSubsetLoxiEndpointsIsStable(t *testing.T) {
+	eps := testLoxiEndpoints(50)
+	subset := subsetLoxiEndpoints("rule", eps, 10)
+	inSubset := subsetKeys(subset)
+
+	for i := range eps {
+		removed := append(append([]loxiapi.LoadBalancerEndpoint{}, eps[:i]...), eps[i+1:]...)
+		changes := subsetChanges(subset, subsetLoxiEndpoints("rule", removed, 10))
+
+		want := 0
+		if _, isok := inSubset[getLoxiEndpointKey(&eps[i])]; isok {
+			want = 1
+		}
+		if changes != want {
+			t.Errorf("removing %s changed %d members, want %d", eps[i].EndpointIP, changes, want)
+		}
+	}
+
+	for _, ep := range testLoxiEndpoints(60)[50:] {
+		one := append(append([]loxiapi.LoadBalancerEndpoint{}, eps...), ep)
+		if changes := subsetChanges(subset, subsetLoxiEndpoints("rule", one, 10)); changes > 1 {
+			t.Errorf("adding %s changed %d members, want at most 1", ep.EndpointIP, changes)
+		}
+	}
+}
+
+func TestReconcileSubsetsMergedRule(t *testing.T) {
+	ingress := testIngress("web", nil,
+		testRule("a.example.com", map[string]string{"/": "web", "/api": "api"}),
+		testRule("b.example.com", map[string]string{"/": "web"}))
+	r, lb := newTestReconciler(t, testFixtures(ingress)...)
+	r.MaxEndpointsPerRule = 2
+	reconcileIngress(t, r, "web")
+
+	// the paths of a.example.com share one rule, which gets 2 of their 3 endpoints
+	rules := lb.endpoints()
+	if got := rules[testRuleKey(80, "a.example.com")]; len(got) != 2 {
+		t.Errorf("endpoints of the merged rule = %v, want 2", got)
+	}
+	if got := rules[testRuleKey(80, "b.example.com")]; len(got) != 2 {
+		t.Errorf("endpoints of the single path rule = %v, want 2", got)
+	}
+}
+
+// positionChanges returns how many positions of the endpoint list a hold another endpoint in b,
+// which is how many hash buckets are remapped when a is replaced by b.
+func positionChanges(a, b []loxiapi.LoadBalancerEndpoint) int {
+	changes := 0
+	for i := range a {
+		if i >= len(b) || getLoxiEndpointKey(&a[i]) != getLoxiEndpointKey(&b[i]) {
+			changes++
+		}
+	}
+	return changes
+}
+
+func TestSortLoxiEndpoints(t *testing.T) {
+	endpoint := func(ip string) loxiapi.LoadBalancerEndpoint {
+		return loxiapi.LoadBalancerEndpoint{EndpointIP: ip, TargetPort: 8080, Weight: 1}
+	}
+	current := []loxiapi.LoadBalancerEndpoint{
+		endpoint("10.0.0.1"), endpoint("10.0.0.2"), endpoint("10.0.0.10"), endpoint("10.0.0.20"),
+	}
+
+	tests := []struct {
+		name        string
+		desired     []loxiapi.LoadBalancerEndpoint
+		wantChanges int
+	}{
+		{
+			name:    "listed in another order",
+			desired: []loxiapi.LoadBalancerEndpoint{endpoint("10.0.0.20"), endpoint("10.0.0.2"), endpoint("10.0.0.10"), endpoint("10.0.0.1")},
+		},
+		{
+			name:        "pod replaced in place",
+			desired:     []loxiapi.LoadBalancerEndpoint{endpoint("10.0.0.15"), endpoint("10.0.0.20"), endpoint("10.0.0.2"), endpoint("10.0.0.1")},
+			wantChanges: 1,
+		},
+		{
+			name:        "pod replaced at the end",
+			desired:     []loxiapi.LoadBalancerEndpoint{endpoint("10.0.0.30"), endpoint("10.0.0.20"), endpoint("10.0.0.2"), endpoint("10.0.0.1")},
+			wantChanges: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sortLoxiEndpoints(tt.desired)
+			// only the positions from the replaced endpoint on are remapped, whatever the order
+			// the endpoints were listed in
+			if changes := positionChanges(current, tt.desired); changes != tt.wantChanges {
+				t.Errorf("%d positions remapped by %v, want %d", changes, tt.desired, tt.wantChanges)
+			}
+		})
+	}
+}
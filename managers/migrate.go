@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"loxilb.io/loxilb-ingress-manager/pkg"
+)
+
+// migrateIngressBackendAnnotations is a one-shot startup task moving every Ingress handled by
+// this controller off the deprecated pkg.ExternalBackendServiceAnnotation scheme.
+func (r *LoxilbIngressReconciler) migrateIngressBackendAnnotations(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("migrate")
+
+	ingressList := &netv1.IngressList{}
+	if err := r.Client.List(ctx, ingressList); err != nil {
+		logger.Error(err, "failed to list ingresses")
+		return nil
+	}
+
+	for i := range ingressList.Items {
+		ingress := &ingressList.Items[i]
+		// the deprecated keys are unprefixed, so leave the Ingresses of other controllers alone
+		selected, err := r.isNamespaceSelected(ctx, ingress.Namespace)
+		if err != nil {
+			logger.Error(err, "failed to get namespace", "namespace", ingress.Namespace)
+			continue
+		}
+		if !selected || !r.isIngressClassHandled(ctx, ingress) ||
+			(r.RequireOptIn && ingress.Annotations[pkg.EnabledAnnotation] != "true") {
+			continue
+		}
+
+		annotations, isok, err := pkg.MigrateBackendAnnotations(ingress.Annotations)
+		if err != nil {
+			logger.Error(err, "failed to migrate backend annotations", "ingress", client.ObjectKeyFromObject(ingress))
+			r.Recorder.Event(ingress, corev1.EventTypeWarning, "InvalidAnnotation",
+				"backend annotations not migrated: "+err.Error())
+			continue
+		}
+		if !isok {
+			continue
+		}
+
+		patch := client.MergeFrom(ingress.DeepCopy())
+		ingress.Annotations = annotations
+		if err := r.Client.Patch(ctx, ingress, patch); err != nil {
+			logger.Error(err, "failed to migrate backend annotations", "ingress", client.ObjectKeyFromObject(ingress))
+			continue
+		}
+		logger.Info("migrated backend annotations", "ingress", client.ObjectKeyFromObject(ingress),
+			pkg.BackendNamespacesAnnotation, annotations[pkg.BackendNamespacesAnnotation])
+	}
+	return nil
+}
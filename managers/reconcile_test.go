@@ -0,0 +1,2250 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"loxilb.io/loxilb-ingress-manager/pkg"
+
+	loxiapi "github.com/loxilb-io/kube-loxilb/pkg/api"
+)
+
+const (
+	testExternalIP      = "10.10.10.1"
+	testIngressClass    = "loxilb"
+	testClassController = "loxilb.io/loxilb-ingress"
+)
+
+// fakeLoadBalancerAPI keeps the rules in memory the way loxilb does: one rule per rule key,
+// with attach and detach operations on the endpoints of an existing rule.
+type fakeLoadBalancerAPI struct {
+	mu    sync.Mutex
+	rules map[string]loxiapi.LoadBalancerModel
+	// calls logs the creates and deletes as "create <key>" and "delete <key>"
+	calls []string
+}
+
+func newFakeLoadBalancerAPI() *fakeLoadBalancerAPI {
+	return &fakeLoadBalancerAPI{rules: make(map[string]loxiapi.LoadBalancerModel)}
+}
+
+func (f *fakeLoadBalancerAPI) List(_ context.Context) (*loxiapi.LoadBalancerListModel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	list := &loxiapi.LoadBalancerListModel{}
+	for _, key := range f.keysLocked() {
+		list.Item = append(list.Item, f.rules[key])
+	}
+	return list, nil
+}
+
+func (f *fakeLoadBalancerAPI) Create(_ context.Context, obj loxiapi.LoxiModel) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	model := obj.(*loxiapi.LoadBalancerModel)
+	key := getLoxiRuleKey(&model.Service)
+	f.calls = append(f.calls, "create "+key)
+	current, isok := f.rules[key]
+	switch model.Service.Oper {
+	case loxiapi.LBOPAttach:
+		if !isok {
+			return fmt.Errorf("attach to missing rule %s", key)
+		}
+		current.Endpoints = append(current.Endpoints, model.Endpoints...)
+	case loxiapi.LBOPDetach:
+		if !isok {
+			return fmt.Errorf("detach from missing rule %s", key)
+		}
+		endpoints := make([]loxiapi.LoadBalancerEndpoint, 0, len(current.Endpoints))
+		for _, ep := range current.Endpoints {
+			if !hasLoxiEndpoint(model.Endpoints, &ep) {
+				endpoints = append(endpoints, ep)
+			}
+		}
+		current.Endpoints = endpoints
+	default:
+		if isok {
+			return fmt.Errorf("rule %s exists", key)
+		}
+		current = loxiapi.LoadBalancerModel{
+			Service:   model.Service,
+			Endpoints: append([]loxiapi.LoadBalancerEndpoint(nil), model.Endpoints...),
+		}
+	}
+	current.Service.Oper = loxiapi.LBOPAdd
+	f.rules[key] = current
+	return nil
+}
+
+func (f *fakeLoadBalancerAPI) Delete(_ context.Context, obj loxiapi.LoxiModel) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	model := obj.(*loxiapi.LoadBalancerModel)
+	f.calls = append(f.calls, "delete "+getLoxiRuleKey(&model.Service))
+	delete(f.rules, getLoxiRuleKey(&model.Service))
+	return nil
+}
+
+func (f *fakeLoadBalancerAPI) DeleteByName(_ context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key, model := range f.rules {
+		if model.Service.Name == name {
+			f.calls = append(f.calls, "delete "+key)
+			delete(f.rules, key)
+		}
+	}
+	return nil
+}
+
+func (f *fakeLoadBalancerAPI) keysLocked() []string {
+	keys := make([]string, 0, len(f.rules))
+	for key := range f.rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// endpoints returns the rule keys mapped to the "ip:port" of their endpoints.
+func (f *fakeLoadBalancerAPI) endpoints() map[string][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rules := make(map[string][]string, len(f.rules))
+	for key, model := range f.rules {
+		eps := make([]string, 0, len(model.Endpoints))
+		for _, ep := range model.Endpoints {
+			eps = append(eps, getLoxiEndpointKey(&ep))
+		}
+		sort.Strings(eps)
+		rules[key] = eps
+	}
+	return rules
+}
+
+func newTestReconciler(t *testing.T, objs ...client.Object) (*LoxilbIngressReconciler, *fakeLoadBalancerAPI) {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	lb := newFakeLoadBalancerAPI()
+	r := &LoxilbIngressReconciler{
+		Scheme:                 scheme,
+		Recorder:               record.NewFakeRecorder(100),
+		LoxiClient:             &loxiapi.LoxiClient{Host: testExternalIP},
+		LoadBalancerAPI:        lb,
+		IngressClassController: testClassController,
+		Finalizer:              DefaultFinalizer,
+	}
+	r.Client = fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objs...).
+		WithStatusSubresource(&netv1.Ingress{}).
+		WithIndex(&netv1.Ingress{}, backendServiceIndexKey, r.indexIngressBackendServices).
+		WithIndex(&netv1.Ingress{}, ingressClassIndexKey, indexIngressClassName).
+		Build()
+	return r, lb
+}
+
+func reconcileIngress(t *testing.T, r *LoxilbIngressReconciler, name string) {
+	t.Helper()
+
+	_, err := r.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{Namespace: "default", Name: name},
+	})
+	if err != nil {
+		t.Fatalf("reconcile %s: %v", name, err)
+	}
+}
+
+func testFixtures(objs ...client.Object) []client.Object {
+	fixtures := []client.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&netv1.IngressClass{
+			ObjectMeta: metav1.ObjectMeta{Name: testIngressClass},
+			Spec:       netv1.IngressClassSpec{Controller: testClassController},
+		},
+		testService("web"),
+		testEndpoints("web", "10.0.0.1", "10.0.0.2"),
+		testService("api"),
+		testEndpoints("api", "10.0.1.1"),
+	}
+	return append(fixtures, objs...)
+}
+
+// testService returns a service exposing port 80 named http on targetPort 8080.
+func testService(name string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080)}},
+		},
+	}
+}
+
+func testEndpoints(name string, ips ...string) *corev1.Endpoints {
+	addresses := make([]corev1.EndpointAddress, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, corev1.EndpointAddress{IP: ip})
+	}
+	return &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: addresses,
+			Ports:     []corev1.EndpointPort{{Name: "http", Port: 8080}},
+		}},
+	}
+}
+
+// testNotReadyBackend returns a backend with the ready endpoint 10.0.3.1 and the not-ready
+// endpoint 10.0.3.2.
+func testNotReadyBackend(name string, publishNotReady bool) []client.Object {
+	svc := testService(name)
+	svc.Spec.PublishNotReadyAddresses = publishNotReady
+	ep := testEndpoints(name, "10.0.3.1")
+	ep.Subsets[0].NotReadyAddresses = []corev1.EndpointAddress{{IP: "10.0.3.2"}}
+	return []client.Object{svc, ep}
+}
+
+func testIngress(name string, annotations map[string]string, rules ...netv1.IngressRule) *netv1.Ingress {
+	className := testIngressClass
+	return &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations},
+		Spec: netv1.IngressSpec{
+			IngressClassName: &className,
+			Rules:            rules,
+		},
+	}
+}
+
+func testRule(host string, paths map[string]string) netv1.IngressRule {
+	pathType := netv1.PathTypePrefix
+	rule := netv1.IngressRule{
+		Host:             host,
+		IngressRuleValue: netv1.IngressRuleValue{HTTP: &netv1.HTTPIngressRuleValue{}},
+	}
+
+	keys := make([]string, 0, len(paths))
+	for path := range paths {
+		keys = append(keys, path)
+	}
+	sort.Strings(keys)
+	for _, path := range keys {
+		rule.HTTP.Paths = append(rule.HTTP.Paths, netv1.HTTPIngressPath{
+			Path:     path,
+			PathType: &pathType,
+			Backend: netv1.IngressBackend{Service: &netv1.IngressServiceBackend{
+				Name: paths[path],
+				Port: netv1.ServiceBackendPort{Number: 80},
+			}},
+		})
+	}
+	return rule
+}
+
+func testRuleKey(port int, host string) string {
+	return fmt.Sprintf("%s|tcp|%d|%s", testExternalIP, port, host)
+}
+
+func TestReconcileProgramsRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		ingress *netv1.Ingress
+		objs    []client.Object
+		want    map[string][]string
+	}{
+		{
+			name:    "direct",
+			ingress: testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"})),
+			want: map[string][]string{
+				testRuleKey(80, "a.example.com"): {"10.0.0.1:8080", "10.0.0.2:8080"},
+			},
+		},
+		{
+			name: "tls",
+			ingress: func() *netv1.Ingress {
+				ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+				ingress.Spec.TLS = []netv1.IngressTLS{{Hosts: []string{"a.example.com"}}}
+				return ingress
+			}(),
+			want: map[string][]string{
+				testRuleKey(443, "a.example.com"): {"10.0.0.1:8080", "10.0.0.2:8080"},
+			},
+		},
+		{
+			name: "multi-path",
+			ingress: testIngress("web", nil,
+				testRule("a.example.com", map[string]string{"/": "web", "/api": "api"}),
+				testRule("b.example.com", map[string]string{"/": "api"})),
+			want: map[string][]string{
+				testRuleKey(80, "a.example.com"): {"10.0.0.1:8080", "10.0.0.2:8080", "10.0.1.1:8080"},
+				testRuleKey(80, "b.example.com"): {"10.0.1.1:8080"},
+			},
+		},
+		{
+			name: "catch-all and host rules",
+			ingress: testIngress("web", nil,
+				testRule("", map[string]string{"/": "api"}),
+				testRule("a.example.com", map[string]string{"/": "web"})),
+			want: map[string][]string{
+				testRuleKey(80, ""):              {"10.0.1.1:8080"},
+				testRuleKey(80, "a.example.com"): {"10.0.0.1:8080", "10.0.0.2:8080"},
+			},
+		},
+		{
+			name: "frontend port",
+			ingress: testIngress("web", map[string]string{pkg.FrontendPortAnnotation: "8000"},
+				testRule("a.example.com", map[string]string{"/": "web"})),
+			want: map[string][]string{
+				testRuleKey(8000, "a.example.com"): {"10.0.0.1:8080", "10.0.0.2:8080"},
+			},
+		},
+		{
+			name: "external ip",
+			ingress: testIngress("web", map[string]string{pkg.ExternalIPAnnotation: "10.10.10.2"},
+				testRule("a.example.com", map[string]string{"/": "web"})),
+			want: map[string][]string{
+				"10.10.10.2|tcp|80|a.example.com": {"10.0.0.1:8080", "10.0.0.2:8080"},
+			},
+		},
+		{
+			name: "maintenance backend",
+			ingress: testIngress("web", map[string]string{pkg.MaintenanceBackendAnnotation: "api"},
+				testRule("a.example.com", map[string]string{"/": "empty"})),
+			objs: []client.Object{testService("empty"), testEndpoints("empty")},
+			want: map[string][]string{
+				testRuleKey(80, "a.example.com"): {"10.0.1.1:8080"},
+			},
+		},
+		{
+			name:    "not-ready endpoints",
+			ingress: testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "flaky"})),
+			objs:    testNotReadyBackend("flaky", false),
+			want: map[string][]string{
+				testRuleKey(80, "a.example.com"): {"10.0.3.1:8080"},
+			},
+		},
+		{
+			name: "publish not-ready annotation",
+			ingress: testIngress("web", map[string]string{pkg.PublishNotReadyAnnotation: "true"},
+				testRule("a.example.com", map[string]string{"/": "flaky"})),
+			objs: testNotReadyBackend("flaky", false),
+			want: map[string][]string{
+				testRuleKey(80, "a.example.com"): {"10.0.3.1:8080", "10.0.3.2:8080"},
+			},
+		},
+		{
+			name:    "service publishing not-ready addresses",
+			ingress: testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "flaky"})),
+			objs:    testNotReadyBackend("flaky", true),
+			want: map[string][]string{
+				testRuleKey(80, "a.example.com"): {"10.0.3.1:8080", "10.0.3.2:8080"},
+			},
+		},
+		{
+			name: "backend namespace",
+			ingress: testIngress("web", map[string]string{pkg.BackendNamespacesAnnotation: "web=backends"},
+				testRule("a.example.com", map[string]string{"/": "web"})),
+			objs: []client.Object{
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "backends"}},
+				func() client.Object {
+					svc := testService("web")
+					svc.Namespace = "backends"
+					return svc
+				}(),
+				func() client.Object {
+					ep := testEndpoints("web", "10.0.2.1")
+					ep.Namespace = "backends"
+					return ep
+				}(),
+			},
+			want: map[string][]string{
+				testRuleKey(80, "a.example.com"): {"10.0.2.1:8080"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, lb := newTestReconciler(t, testFixtures(append(tt.objs, tt.ingress)...)...)
+			reconcileIngress(t, r, tt.ingress.Name)
+
+			got := lb.endpoints()
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("rules = %v, want %v", got, tt.want)
+			}
+			for key := range got {
+				if name := lb.rules[key].Service.Name; name != "default_web" {
+					t.Errorf("rule %s named %q, want default_web", key, name)
+				}
+			}
+
+			ingress := &netv1.Ingress{}
+			if err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(tt.ingress), ingress); err != nil {
+				t.Fatal(err)
+			}
+			if !controllerutil.ContainsFinalizer(ingress, DefaultFinalizer) {
+				t.Errorf("finalizers = %v, want %s", ingress.Finalizers, DefaultFinalizer)
+			}
+			if len(ingress.Status.LoadBalancer.Ingress) != 1 {
+				t.Errorf("status = %+v, want one address", ingress.Status.LoadBalancer)
+			}
+		})
+	}
+}
+
+func TestReconcileBackendPort(t *testing.T) {
+	tests := []struct {
+		name     string
+		port     netv1.ServiceBackendPort
+		wantPort string
+	}{
+		{name: "number", port: netv1.ServiceBackendPort{Number: 80}},
+		{name: "name", port: netv1.ServiceBackendPort{Name: "http"}},
+		{name: "missing number", port: netv1.ServiceBackendPort{Number: 81}, wantPort: "81"},
+		{name: "missing name", port: netv1.ServiceBackendPort{Name: "grpc"}, wantPort: "grpc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+			ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Port = tt.port
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+
+			_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ingress)})
+			if tt.wantPort == "" {
+				if err != nil || len(lb.endpoints()) != 1 {
+					t.Errorf("reconcile error = %v, rules = %v, want the ingress programmed", err, lb.endpoints())
+				}
+				return
+			}
+
+			var portErr *BackendPortNotFoundError
+			if !errors.As(err, &portErr) || portErr.Port != tt.wantPort {
+				t.Fatalf("reconcile error = %v, want port %s not found", err, tt.wantPort)
+			}
+			if rules := lb.endpoints(); len(rules) != 0 {
+				t.Errorf("rules = %v, want none", rules)
+			}
+			if events := drainEvents(r); !strings.Contains(events, "BackendPortNotFound") {
+				t.Errorf("events = %q, want BackendPortNotFound", events)
+			}
+		})
+	}
+}
+
+func TestReconcileNamedTargetPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		subsets []corev1.EndpointSubset
+		want    []string
+	}{
+		{
+			name: "one number",
+			subsets: []corev1.EndpointSubset{{
+				Addresses: []corev1.EndpointAddress{{IP: "10.0.3.1"}, {IP: "10.0.3.2"}},
+				Ports:     []corev1.EndpointPort{{Name: "web", Port: 9090}},
+			}},
+			want: []string{"10.0.3.1:9090", "10.0.3.2:9090"},
+		},
+		{
+			name: "number per endpoint",
+			subsets: []corev1.EndpointSubset{
+				{Addresses: []corev1.EndpointAddress{{IP: "10.0.3.1"}}, Ports: []corev1.EndpointPort{{Name: "web", Port: 9090}}},
+				{Addresses: []corev1.EndpointAddress{{IP: "10.0.3.2"}}, Ports: []corev1.EndpointPort{{Name: "web", Port: 9091}}},
+			},
+			want: []string{"10.0.3.1:9090", "10.0.3.2:9091"},
+		},
+		{
+			name: "other port names",
+			subsets: []corev1.EndpointSubset{{
+				Addresses: []corev1.EndpointAddress{{IP: "10.0.3.1"}},
+				Ports:     []corev1.EndpointPort{{Name: "metrics", Port: 9100}, {Name: "web", Port: 9090}},
+			}},
+			want: []string{"10.0.3.1:9090"},
+		},
+		{
+			name: "port missing from endpoints",
+			subsets: []corev1.EndpointSubset{{
+				Addresses: []corev1.EndpointAddress{{IP: "10.0.3.1"}},
+				Ports:     []corev1.EndpointPort{{Name: "metrics", Port: 9100}},
+			}},
+			want: []string{"10.0.3.1:8000"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "named"}))
+			ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Port.Number = 8000
+			backend := testNamedPortBackend("named")
+			backend[1].(*corev1.Endpoints).Subsets = tt.subsets
+			r, lb := newTestReconciler(t, testFixtures(append(backend, ingress)...)...)
+			reconcileIngress(t, r, "web")
+
+			if got := lb.endpoints()[testRuleKey(80, "a.example.com")]; fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("endpoints = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileInvalidExternalIP(t *testing.T) {
+	tests := []struct {
+		name string
+		host string
+	}{
+		{name: "empty host"},
+		{name: "hostname", host: "loxilb.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			r.LoxiClient.Host = tt.host
+
+			_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ingress)})
+			var ipErr *InvalidExternalIPError
+			if !errors.As(err, &ipErr) || ipErr.IP != tt.host {
+				t.Fatalf("reconcile error = %v, want invalid external IP %q", err, tt.host)
+			}
+			if rules := lb.endpoints(); len(rules) != 0 {
+				t.Errorf("rules = %v, want none", rules)
+			}
+			if events := drainEvents(r); !strings.Contains(events, "InvalidExternalIP") {
+				t.Errorf("events = %q, want InvalidExternalIP", events)
+			}
+		})
+	}
+}
+
+func TestReconcileIPFamily(t *testing.T) {
+	tests := []struct {
+		name         string
+		family       string
+		externalIPv6 string
+		want         []string
+		wantErr      string
+	}{
+		{name: "primary", externalIPv6: "fd00::1", want: []string{testExternalIP}},
+		{name: "ipv4", family: "ipv4", externalIPv6: "fd00::1", want: []string{testExternalIP}},
+		{name: "ipv6", family: "ipv6", externalIPv6: "fd00::1", want: []string{"fd00::1"}},
+		{name: "dual", family: "dual", externalIPv6: "fd00::1", want: []string{testExternalIP, "fd00::1"}},
+		{name: "ipv6 unavailable", family: "ipv6", wantErr: "IPv6"},
+		{name: "dual unavailable", family: "dual", wantErr: "IPv6"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var annotations map[string]string
+			if tt.family != "" {
+				annotations = map[string]string{pkg.IPFamilyAnnotation: tt.family}
+			}
+			ingress := testIngress("web", annotations, testRule("a.example.com", map[string]string{"/": "web"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			r.ExternalIPv6 = tt.externalIPv6
+
+			_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ingress)})
+			if tt.wantErr != "" {
+				var familyErr *IPFamilyUnavailableError
+				if !errors.As(err, &familyErr) || familyErr.Family != tt.wantErr {
+					t.Fatalf("reconcile error = %v, want %s unavailable", err, tt.wantErr)
+				}
+				if len(lb.rules) != 0 {
+					t.Errorf("rules = %v, want none", lb.endpoints())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			programmed := make([]string, 0, len(lb.rules))
+			for _, model := range lb.rules {
+				programmed = append(programmed, model.Service.ExternalIP)
+			}
+			slices.Sort(programmed)
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if fmt.Sprint(programmed) != fmt.Sprint(want) {
+				t.Errorf("rules are programmed on %v, want %v", programmed, want)
+			}
+
+			// the status reports every address the rules are programmed on
+			got := &netv1.Ingress{}
+			if err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(ingress), got); err != nil {
+				t.Fatal(err)
+			}
+			status := make([]string, 0, len(got.Status.LoadBalancer.Ingress))
+			for _, lbIngress := range got.Status.LoadBalancer.Ingress {
+				status = append(status, lbIngress.IP)
+			}
+			slices.Sort(status)
+			if fmt.Sprint(status) != fmt.Sprint(want) {
+				t.Errorf("status IPs = %v, want %v", status, want)
+			}
+		})
+	}
+}
+
+func TestReconcileEndpointMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		service func(*corev1.Service)
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "pod",
+			mode: "pod",
+			want: []string{"10.0.8.1:8080", "10.0.8.2:8080"},
+		},
+		{
+			name:    "cluster",
+			mode:    "cluster",
+			service: func(svc *corev1.Service) { svc.Spec.ClusterIP = "10.96.0.10" },
+			want:    []string{"10.96.0.10:80"},
+		},
+		{
+			name:    "cluster without cluster ip",
+			mode:    "cluster",
+			service: func(svc *corev1.Service) { svc.Spec.ClusterIP = corev1.ClusterIPNone },
+			wantErr: true,
+		},
+		{
+			name: "loadbalancer",
+			mode: "loadbalancer",
+			service: func(svc *corev1.Service) {
+				svc.Spec.Type = corev1.ServiceTypeLoadBalancer
+				svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: "lb.example.com"}, {IP: "192.168.10.1"}}
+			},
+			want: []string{"192.168.10.1:80"},
+		},
+		{
+			name:    "loadbalancer without ip yet",
+			mode:    "loadbalancer",
+			service: func(svc *corev1.Service) { svc.Spec.Type = corev1.ServiceTypeLoadBalancer },
+			wantErr: true,
+		},
+		{
+			name:    "loadbalancer on a cluster ip service",
+			mode:    "loadbalancer",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := testService("backend")
+			if tt.service != nil {
+				tt.service(svc)
+			}
+			ingress := testIngress("web", map[string]string{pkg.EndpointModeAnnotation: tt.mode},
+				testRule("a.example.com", map[string]string{"/": "backend"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress, svc, testEndpoints("backend", "10.0.8.1", "10.0.8.2"))...)
+
+			_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ingress)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reconcile error = %v, want error %t", err, tt.wantErr)
+			}
+			if got := lb.endpoints()[testRuleKey(80, "a.example.com")]; fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("endpoints = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileExternalTrafficPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   corev1.ServiceExternalTrafficPolicy
+		nodeName string
+		want     []string
+	}{
+		{name: "cluster", policy: corev1.ServiceExternalTrafficPolicyCluster, nodeName: "node-1", want: []string{"10.0.9.1:8080", "10.0.9.2:8080"}},
+		{name: "local", policy: corev1.ServiceExternalTrafficPolicyLocal, nodeName: "node-1", want: []string{"10.0.9.1:8080"}},
+		{name: "local on an unknown node", policy: corev1.ServiceExternalTrafficPolicyLocal, want: []string{"10.0.9.1:8080", "10.0.9.2:8080"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := testService("local")
+			svc.Spec.ExternalTrafficPolicy = tt.policy
+			ep := testEndpoints("local", "10.0.9.1", "10.0.9.2")
+			ep.Subsets[0].Addresses[0].NodeName = ptrTo("node-1")
+			ep.Subsets[0].Addresses[1].NodeName = ptrTo("node-2")
+			ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "local"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress, svc, ep)...)
+			r.NodeName = tt.nodeName
+			reconcileIngress(t, r, "web")
+
+			if got := lb.endpoints()[testRuleKey(80, "a.example.com")]; fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("endpoints = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileTargetContainer(t *testing.T) {
+	// both containers of the pod declare a port named http
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "multi-0"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}},
+			{Name: "sidecar", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 9090}}},
+		}},
+	}
+	svc := testService("multi")
+	svc.Spec.Ports[0].TargetPort = intstr.FromString("http")
+	ep := testEndpoints("multi", "10.0.7.1")
+	ep.Subsets[0].Addresses[0].TargetRef = &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "multi-0"}
+
+	tests := []struct {
+		name      string
+		container string
+		want      []string
+	}{
+		{name: "endpoints port", want: []string{"10.0.7.1:8080"}},
+		{name: "first container", container: "app", want: []string{"10.0.7.1:8080"}},
+		{name: "second container", container: "sidecar", want: []string{"10.0.7.1:9090"}},
+		{name: "unknown container", container: "proxy", want: []string{"10.0.7.1:8080"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var annotations map[string]string
+			if tt.container != "" {
+				annotations = map[string]string{pkg.TargetContainerAnnotation + "-multi": tt.container}
+			}
+			ingress := testIngress("web", annotations, testRule("a.example.com", map[string]string{"/": "multi"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress, pod.DeepCopy(), svc.DeepCopy(), ep.DeepCopy())...)
+			reconcileIngress(t, r, "web")
+
+			if got := lb.endpoints()[testRuleKey(80, "a.example.com")]; fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("endpoints = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileStatusPorts(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		tlsHosts    []string
+		want        []netv1.IngressPortStatus
+	}{
+		{
+			name: "http",
+			want: []netv1.IngressPortStatus{{Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+		{
+			name:     "http and https",
+			tlsHosts: []string{"a.example.com"},
+			want:     []netv1.IngressPortStatus{{Port: 80, Protocol: corev1.ProtocolTCP}, {Port: 443, Protocol: corev1.ProtocolTCP}},
+		},
+		{
+			name:        "frontend port",
+			annotations: map[string]string{pkg.FrontendPortAnnotation: "8000"},
+			want:        []netv1.IngressPortStatus{{Port: 8000, Protocol: corev1.ProtocolTCP}},
+		},
+		{
+			name:        "udp",
+			annotations: map[string]string{pkg.ForceL4Annotation: "true", pkg.L4ProtocolAnnotation: "udp"},
+			want:        []netv1.IngressPortStatus{{Port: 80, Protocol: corev1.ProtocolUDP}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", tt.annotations,
+				testRule("a.example.com", map[string]string{"/": "web"}),
+				testRule("b.example.com", map[string]string{"/": "web"}))
+			if tt.tlsHosts != nil {
+				ingress.Spec.TLS = []netv1.IngressTLS{{Hosts: tt.tlsHosts}}
+			}
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			reconcileIngress(t, r, "web")
+
+			// the status lists the ports of the programmed rules
+			programmed := make(map[string]bool)
+			for _, model := range lb.rules {
+				programmed[fmt.Sprintf("%d/%s", model.Service.Port, strings.ToUpper(model.Service.Protocol))] = true
+			}
+			got := &netv1.Ingress{}
+			if err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(ingress), got); err != nil {
+				t.Fatal(err)
+			}
+			status := got.Status.LoadBalancer.Ingress
+			if len(status) != 1 || fmt.Sprint(status[0].Ports) != fmt.Sprint(tt.want) {
+				t.Fatalf("status = %+v, want ports %v", status, tt.want)
+			}
+			for _, port := range status[0].Ports {
+				if !programmed[fmt.Sprintf("%d/%s", port.Port, port.Protocol)] {
+					t.Errorf("status port %d/%s is not programmed", port.Port, port.Protocol)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileForceL4(t *testing.T) {
+	tests := []struct {
+		name     string
+		forceL4  string
+		tls      bool
+		want     map[string][]string
+		wantMode loxiapi.LbMode
+	}{
+		{
+			name:     "off",
+			want:     map[string][]string{testRuleKey(80, "a.example.com"): {"10.0.0.1:8080", "10.0.0.2:8080", "10.0.1.1:8080"}},
+			wantMode: loxiapi.LBModeFullProxy,
+		},
+		{
+			name:     "on",
+			forceL4:  "true",
+			want:     map[string][]string{testRuleKey(80, ""): {"10.0.0.1:8080", "10.0.0.2:8080", "10.0.1.1:8080"}},
+			wantMode: loxiapi.LBModeFullNAT,
+		},
+		{
+			name:     "on with tls",
+			forceL4:  "true",
+			tls:      true,
+			want:     map[string][]string{testRuleKey(443, ""): {"10.0.0.1:8080", "10.0.0.2:8080", "10.0.1.1:8080"}},
+			wantMode: loxiapi.LBModeFullNAT,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var annotations map[string]string
+			if tt.forceL4 != "" {
+				annotations = map[string]string{pkg.ForceL4Annotation: tt.forceL4}
+			}
+			ingress := testIngress("web", annotations, testRule("a.example.com", map[string]string{"/": "web", "/api": "api"}))
+			if tt.tls {
+				ingress.Spec.TLS = []netv1.IngressTLS{{Hosts: []string{"a.example.com"}}}
+			}
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			reconcileIngress(t, r, "web")
+
+			if got := lb.endpoints(); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("rules = %v, want %v", got, tt.want)
+			}
+			for key, model := range lb.rules {
+				if model.Service.Mode != tt.wantMode || (tt.forceL4 != "" && model.Service.Security != 0) {
+					t.Errorf("rule %s mode = %d, security = %d, want mode %d", key, model.Service.Mode, model.Service.Security, tt.wantMode)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileL4Protocol(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantKey     string
+		wantErr     bool
+	}{
+		{name: "default", annotations: map[string]string{pkg.ForceL4Annotation: "true"}, wantKey: testExternalIP + "|tcp|80|"},
+		{name: "tcp", annotations: map[string]string{pkg.ForceL4Annotation: "true", pkg.L4ProtocolAnnotation: "tcp"}, wantKey: testExternalIP + "|tcp|80|"},
+		{name: "udp", annotations: map[string]string{pkg.ForceL4Annotation: "true", pkg.L4ProtocolAnnotation: "udp"}, wantKey: testExternalIP + "|udp|80|"},
+		{name: "sctp", annotations: map[string]string{pkg.ForceL4Annotation: "true", pkg.L4ProtocolAnnotation: "sctp"}, wantKey: testExternalIP + "|sctp|80|"},
+		{name: "udp without force l4", annotations: map[string]string{pkg.L4ProtocolAnnotation: "udp"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", tt.annotations, testRule("a.example.com", map[string]string{"/": "web"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+
+			_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ingress)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reconcile error = %v, want error %t", err, tt.wantErr)
+			}
+			rules := lb.endpoints()
+			if tt.wantErr {
+				if len(rules) != 0 {
+					t.Errorf("rules = %v, want none", rules)
+				}
+				return
+			}
+			if _, isok := rules[tt.wantKey]; !isok || len(rules) != 1 {
+				t.Errorf("rules = %v, want %s", rules, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestReconcileNatMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		natMode  string
+		wantMode loxiapi.LbMode
+		wantErr  bool
+	}{
+		{name: "default", wantMode: loxiapi.LBModeFullNAT},
+		{name: "fullnat", natMode: "fullnat", wantMode: loxiapi.LBModeFullNAT},
+		{name: "onearm", natMode: "onearm", wantMode: loxiapi.LBModeOneArm},
+		{name: "dnat", natMode: "dnat", wantMode: loxiapi.LBModeDefault},
+		{name: "dsr", natMode: "dsr", wantMode: loxiapi.LBModeDSR},
+		{name: "invalid", natMode: "snat", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{pkg.ForceL4Annotation: "true"}
+			if tt.natMode != "" {
+				annotations[pkg.NatModeAnnotation] = tt.natMode
+			}
+			ingress := testIngress("web", annotations, testRule("a.example.com", map[string]string{"/": "web"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+
+			_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ingress)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reconcile error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if rules := lb.endpoints(); len(rules) != 0 {
+					t.Errorf("rules = %v, want none", rules)
+				}
+				return
+			}
+			if len(lb.rules) != 1 {
+				t.Fatalf("rules = %v, want one", lb.endpoints())
+			}
+			for key, model := range lb.rules {
+				if model.Service.Mode != tt.wantMode {
+					t.Errorf("rule %s mode = %d, want %d", key, model.Service.Mode, tt.wantMode)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileSkipStatusUpdate(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		global     bool
+		wantStatus bool
+	}{
+		{name: "default", wantStatus: true},
+		{name: "annotation", annotation: "true"},
+		{name: "annotation false", annotation: "false", wantStatus: true},
+		{name: "global flag", global: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var annotations map[string]string
+			if tt.annotation != "" {
+				annotations = map[string]string{pkg.SkipStatusUpdateAnnotation: tt.annotation}
+			}
+			ingress := testIngress("web", annotations, testRule("a.example.com", map[string]string{"/": "web"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			r.SkipStatusUpdate = tt.global
+			reconcileIngress(t, r, "web")
+
+			if rules := lb.endpoints(); len(rules) != 1 {
+				t.Errorf("rules = %v, want the ingress programmed", rules)
+			}
+			got := &netv1.Ingress{}
+			if err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(ingress), got); err != nil {
+				t.Fatal(err)
+			}
+			if hasStatus := len(got.Status.LoadBalancer.Ingress) > 0; hasStatus != tt.wantStatus {
+				t.Errorf("status = %+v, want written %t", got.Status.LoadBalancer, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestReconcileTLSSecurity(t *testing.T) {
+	tests := []struct {
+		name         string
+		security     string
+		frontendPort string
+		// want maps the rule keys of the TLS host a and the plain host b to their security
+		want map[string]int32
+	}{
+		{
+			name: "derived from tls",
+			want: map[string]int32{testRuleKey(443, "a.example.com"): 1, testRuleKey(80, "b.example.com"): 0},
+		},
+		{
+			name:     "none overrides tls",
+			security: "none",
+			want:     map[string]int32{testRuleKey(80, "a.example.com"): 0, testRuleKey(80, "b.example.com"): 0},
+		},
+		{
+			name:     "https",
+			security: "https",
+			want:     map[string]int32{testRuleKey(443, "a.example.com"): 1, testRuleKey(443, "b.example.com"): 1},
+		},
+		{
+			name:     "e2e",
+			security: "e2e",
+			want:     map[string]int32{testRuleKey(443, "a.example.com"): 2, testRuleKey(443, "b.example.com"): 2},
+		},
+		{
+			name:         "tls on a custom port",
+			frontendPort: "8443",
+			want:         map[string]int32{testRuleKey(8443, "a.example.com"): 1, testRuleKey(8443, "b.example.com"): 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", nil,
+				testRule("a.example.com", map[string]string{"/": "web"}),
+				testRule("b.example.com", map[string]string{"/": "web"}))
+			ingress.Annotations = make(map[string]string)
+			if tt.security != "" {
+				ingress.Annotations[pkg.SecurityAnnotation] = tt.security
+			}
+			if tt.frontendPort != "" {
+				ingress.Annotations[pkg.FrontendPortAnnotation] = tt.frontendPort
+			}
+			ingress.Spec.TLS = []netv1.IngressTLS{{Hosts: []string{"a.example.com"}}}
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			reconcileIngress(t, r, "web")
+
+			got := make(map[string]int32)
+			for key, model := range lb.rules {
+				got[key] = model.Service.Security
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("security = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileEpSelectPerBackend(t *testing.T) {
+	twoHosts := []netv1.IngressRule{
+		testRule("a.example.com", map[string]string{"/": "web"}),
+		testRule("b.example.com", map[string]string{"/": "api"}),
+	}
+	tests := []struct {
+		name         string
+		annotations  map[string]string
+		rules        []netv1.IngressRule
+		want         map[string]loxiapi.EpSelect
+		wantConflict bool
+	}{
+		{
+			name:  "round robin by default",
+			rules: twoHosts,
+			want: map[string]loxiapi.EpSelect{
+				testRuleKey(80, "a.example.com"): loxiapi.LbSelRr,
+				testRuleKey(80, "b.example.com"): loxiapi.LbSelRr,
+			},
+		},
+		{
+			name:        "per backend over ingress",
+			annotations: map[string]string{pkg.EpSelectAnnotation: "hash", pkg.EpSelectAnnotation + "-api": "lc"},
+			rules:       twoHosts,
+			want: map[string]loxiapi.EpSelect{
+				testRuleKey(80, "a.example.com"): loxiapi.LbSelHash,
+				testRuleKey(80, "b.example.com"): loxiapi.LbSelLeastConnections,
+			},
+		},
+		{
+			name:         "conflict on a shared rule",
+			annotations:  map[string]string{pkg.EpSelectAnnotation + "-api": "lc"},
+			rules:        []netv1.IngressRule{testRule("a.example.com", map[string]string{"/": "web", "/api": "api"})},
+			wantConflict: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", tt.annotations, tt.rules...)
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+
+			_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ingress)})
+			var conflictErr *EpSelectConflictError
+			if errors.As(err, &conflictErr) != tt.wantConflict {
+				t.Fatalf("reconcile error = %v, want conflict %t", err, tt.wantConflict)
+			}
+
+			got := make(map[string]loxiapi.EpSelect)
+			for key, model := range lb.rules {
+				got[key] = model.Service.Sel
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("epselect = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileOrphanTLSHosts(t *testing.T) {
+	tests := []struct {
+		name       string
+		tlsHosts   []string
+		wantEvents []string
+	}{
+		{name: "covered", tlsHosts: []string{"a.example.com"}},
+		{
+			name:       "orphan",
+			tlsHosts:   []string{"a.example.com", "b.example.com"},
+			wantEvents: []string{"Warning OrphanTLSHost TLS host b.example.com is not used by any rule"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+			ingress.Spec.TLS = []netv1.IngressTLS{{Hosts: tt.tlsHosts}}
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			reconcileIngress(t, r, "web")
+
+			// the valid hosts are programmed anyway
+			if rules := lb.endpoints(); len(rules[testRuleKey(443, "a.example.com")]) == 0 {
+				t.Errorf("rules = %v, want a.example.com programmed", rules)
+			}
+			events := drainEvents(r)
+			if strings.Count(events, "OrphanTLSHost") != len(tt.wantEvents) {
+				t.Errorf("events = %q, want %q", events, tt.wantEvents)
+			}
+			for _, want := range tt.wantEvents {
+				if !strings.Contains(events, want) {
+					t.Errorf("events = %q, want %q", events, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileUpdatesEndpoints(t *testing.T) {
+	ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+	r, lb := newTestReconciler(t, testFixtures(ingress)...)
+	reconcileIngress(t, r, "web")
+
+	ctx := context.Background()
+	endpoints := &corev1.Endpoints{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: "default", Name: "web"}, endpoints); err != nil {
+		t.Fatal(err)
+	}
+	endpoints.Subsets = testEndpoints("web", "10.0.0.2", "10.0.0.3").Subsets
+	if err := r.Client.Update(ctx, endpoints); err != nil {
+		t.Fatal(err)
+	}
+	// a backend change does not change the Ingress, so it is marked dirty like the watch does
+	if requests := r.findIngressesForBackend(ctx, endpoints); len(requests) != 1 {
+		t.Fatalf("requests = %v, want the ingress", requests)
+	}
+	reconcileIngress(t, r, "web")
+
+	want := []string{"10.0.0.2:8080", "10.0.0.3:8080"}
+	if got := lb.endpoints()[testRuleKey(80, "a.example.com")]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("endpoints = %v, want %v", got, want)
+	}
+}
+
+// emptyRuleWatcher fails the test whenever a loxilb call leaves the rule of key without endpoints.
+type emptyRuleWatcher struct {
+	*fakeLoadBalancerAPI
+	t   *testing.T
+	key string
+}
+
+func (w *emptyRuleWatcher) check(op string) {
+	if eps := w.endpoints()[w.key]; len(eps) == 0 {
+		w.t.Errorf("rule %s has no endpoints after %s", w.key, op)
+	}
+}
+
+func (w *emptyRuleWatcher) Create(ctx context.Context, obj loxiapi.LoxiModel) error {
+	err := w.fakeLoadBalancerAPI.Create(ctx, obj)
+	w.check("create")
+	return err
+}
+
+func (w *emptyRuleWatcher) Delete(ctx context.Context, obj loxiapi.LoxiModel) error {
+	err := w.fakeLoadBalancerAPI.Delete(ctx, obj)
+	w.check("delete")
+	return err
+}
+
+func TestReconcileChangesBackendMakeBeforeBreak(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths map[string]string
+		want  []string
+	}{
+		{
+			name:  "replace backend",
+			paths: map[string]string{"/": "api"},
+			want:  []string{"10.0.1.1:8080"},
+		},
+		{
+			name:  "add backend",
+			paths: map[string]string{"/": "web", "/api": "api"},
+			want:  []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.1.1:8080"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			reconcileIngress(t, r, "web")
+
+			key := testRuleKey(80, "a.example.com")
+			r.LoadBalancerAPI = &emptyRuleWatcher{fakeLoadBalancerAPI: lb, t: t, key: key}
+			updateObject(t, r, client.ObjectKeyFromObject(ingress), &netv1.Ingress{}, func(ingress *netv1.Ingress) {
+				ingress.Spec.Rules = []netv1.IngressRule{testRule("a.example.com", tt.paths)}
+			})
+			reconcileIngress(t, r, "web")
+
+			if got := lb.endpoints()[key]; fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("endpoints = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileBackendCreatedLater(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		namespace   string
+	}{
+		{name: "same namespace", namespace: "default"},
+		{name: "backend namespace", annotations: map[string]string{pkg.BackendNamespacesAnnotation: "late=backends"}, namespace: "backends"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			ingress := testIngress("web", tt.annotations, testRule("a.example.com", map[string]string{"/": "late"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "backends"}})...)
+			if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ingress)}); err == nil {
+				t.Fatalf("reconcile succeeded without the backend")
+			}
+
+			svc := testService("late")
+			svc.Namespace = tt.namespace
+			ep := testEndpoints("late", "10.0.4.1")
+			ep.Namespace = tt.namespace
+			for _, obj := range []client.Object{svc, ep} {
+				if err := r.Client.Create(ctx, obj); err != nil {
+					t.Fatal(err)
+				}
+			}
+			requests := r.findIngressesForBackend(ctx, svc)
+			if len(requests) != 1 || requests[0].NamespacedName != client.ObjectKeyFromObject(ingress) {
+				t.Fatalf("requests = %v, want the ingress", requests)
+			}
+			reconcileIngress(t, r, "web")
+
+			want := map[string][]string{testRuleKey(80, "a.example.com"): {"10.0.4.1:8080"}}
+			if got := lb.endpoints(); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("rules = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReconcileMaintenanceBackendFailover(t *testing.T) {
+	ingress := testIngress("web", map[string]string{pkg.MaintenanceBackendAnnotation: "api"},
+		testRule("a.example.com", map[string]string{"/": "primary"}))
+	r, lb := newTestReconciler(t, testFixtures(ingress, testService("primary"), testEndpoints("primary", "10.0.2.1"))...)
+	reconcileIngress(t, r, "web")
+
+	// each step sets the endpoints of the primary backend
+	steps := []struct {
+		name string
+		ips  []string
+		want []string
+	}{
+		{name: "to maintenance", want: []string{"10.0.1.1:8080"}},
+		{name: "back to primary", ips: []string{"10.0.2.2"}, want: []string{"10.0.2.2:8080"}},
+	}
+	for _, step := range steps {
+		endpoints := &corev1.Endpoints{}
+		updateObject(t, r, types.NamespacedName{Namespace: "default", Name: "primary"}, endpoints, func(endpoints *corev1.Endpoints) {
+			endpoints.Subsets = testEndpoints("primary", step.ips...).Subsets
+		})
+		r.findIngressesForBackend(context.Background(), endpoints)
+		reconcileIngress(t, r, "web")
+
+		if got := lb.endpoints()[testRuleKey(80, "a.example.com")]; fmt.Sprint(got) != fmt.Sprint(step.want) {
+			t.Errorf("%s: endpoints = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestReconcileMissingBackend(t *testing.T) {
+	kept := map[string][]string{
+		testRuleKey(80, "a.example.com"): {"10.0.0.1:8080", "10.0.0.2:8080"},
+		testRuleKey(80, "b.example.com"): {"10.0.1.1:8080"},
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		// missingFor is how long the service has already been found missing
+		missingFor time.Duration
+		wantErr    bool
+		want       map[string][]string
+	}{
+		{
+			name:    "keep",
+			wantErr: true,
+			want:    kept,
+		},
+		{
+			name:        "maintenance during grace period",
+			annotations: map[string]string{pkg.MissingBackendAnnotation: "maintenance", pkg.MaintenanceBackendAnnotation: "api", pkg.MissingBackendGraceAnnotation: "1h"},
+			wantErr:     true,
+			want:        kept,
+		},
+		{
+			name:        "maintenance after grace period",
+			annotations: map[string]string{pkg.MissingBackendAnnotation: "maintenance", pkg.MaintenanceBackendAnnotation: "api", pkg.MissingBackendGraceAnnotation: "1h"},
+			missingFor:  2 * time.Hour,
+			want: map[string][]string{
+				testRuleKey(80, "a.example.com"): {"10.0.1.1:8080"},
+				testRuleKey(80, "b.example.com"): {"10.0.1.1:8080"},
+			},
+		},
+		{
+			name:        "maintenance",
+			annotations: map[string]string{pkg.MissingBackendAnnotation: "maintenance", pkg.MaintenanceBackendAnnotation: "api"},
+			want: map[string][]string{
+				testRuleKey(80, "a.example.com"): {"10.0.1.1:8080"},
+				testRuleKey(80, "b.example.com"): {"10.0.1.1:8080"},
+			},
+		},
+		{
+			name:        "remove",
+			annotations: map[string]string{pkg.MissingBackendAnnotation: "remove"},
+			want:        map[string][]string{testRuleKey(80, "b.example.com"): {"10.0.1.1:8080"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			ingress := testIngress("web", tt.annotations,
+				testRule("a.example.com", map[string]string{"/": "web"}),
+				testRule("b.example.com", map[string]string{"/": "api"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			reconcileIngress(t, r, "web")
+
+			service := testService("web")
+			if err := r.Client.Delete(ctx, service); err != nil {
+				t.Fatal(err)
+			}
+			r.findIngressesForBackend(ctx, service)
+			if tt.missingFor != 0 {
+				r.missingBackends.Store(client.ObjectKeyFromObject(service), time.Now().Add(-tt.missingFor))
+			}
+			drainEvents(r)
+
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ingress)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reconcile error = %v, want error %t", err, tt.wantErr)
+			}
+			if got := lb.endpoints(); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("rules = %v, want %v", got, tt.want)
+			}
+			if events := drainEvents(r); strings.Contains(events, "BackendMissing") == tt.wantErr {
+				t.Errorf("events = %q, want BackendMissing %t", events, !tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReconcileLoxiRateLimit(t *testing.T) {
+	tests := []struct {
+		name        string
+		burst       int
+		wantRules   int
+		wantRequeue time.Duration
+	}{
+		{name: "within the limit", burst: 3, wantRules: 2},
+		{name: "beyond the limit", burst: 2, wantRules: 1, wantRequeue: loxiRateLimitRequeue},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", nil,
+				testRule("a.example.com", map[string]string{"/": "web"}),
+				testRule("b.example.com", map[string]string{"/": "web"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			// listing the rules takes a token; the tokens spent are not refilled during the test
+			r.LoxiRateLimiter = flowcontrol.NewTokenBucketRateLimiter(0.001, tt.burst)
+
+			result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ingress)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.RequeueAfter != tt.wantRequeue {
+				t.Errorf("requeue after = %s, want %s", result.RequeueAfter, tt.wantRequeue)
+			}
+			if rules := lb.endpoints(); len(rules) != tt.wantRules {
+				t.Errorf("rules = %v, want %d", rules, tt.wantRules)
+			}
+		})
+	}
+}
+
+// duplicatingLoadBalancerAPI lists duplicate along with the rules, until its rule key is deleted.
+type duplicatingLoadBalancerAPI struct {
+	*fakeLoadBalancerAPI
+	duplicate *loxiapi.LoadBalancerModel
+}
+
+func (d *duplicatingLoadBalancerAPI) List(ctx context.Context) (*loxiapi.LoadBalancerListModel, error) {
+	list, err := d.fakeLoadBalancerAPI.List(ctx)
+	if err == nil && d.duplicate != nil {
+		list.Item = append(list.Item, *d.duplicate)
+	}
+	return list, err
+}
+
+func (d *duplicatingLoadBalancerAPI) Delete(ctx context.Context, obj loxiapi.LoxiModel) error {
+	model := obj.(*loxiapi.LoadBalancerModel)
+	if d.duplicate != nil && getLoxiRuleKey(&model.Service) == getLoxiRuleKey(&d.duplicate.Service) {
+		d.duplicate = nil
+	}
+	return d.fakeLoadBalancerAPI.Delete(ctx, obj)
+}
+
+func TestReconcileRemovesDuplicateRules(t *testing.T) {
+	ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+	r, lb := newTestReconciler(t, testFixtures(ingress)...)
+	service := r.createLoxiLoadBalancerService("default", "web", testExternalIP, 0, "a.example.com", 0)
+	seeded := &loxiapi.LoadBalancerModel{
+		Service:   service,
+		Endpoints: []loxiapi.LoadBalancerEndpoint{{EndpointIP: "10.0.0.1", TargetPort: 8080, Weight: 1}},
+	}
+	if err := lb.Create(context.Background(), seeded); err != nil {
+		t.Fatal(err)
+	}
+	r.LoadBalancerAPI = &duplicatingLoadBalancerAPI{
+		fakeLoadBalancerAPI: lb,
+		duplicate: &loxiapi.LoadBalancerModel{
+			Service:   service,
+			Endpoints: []loxiapi.LoadBalancerEndpoint{{EndpointIP: "10.0.9.9", TargetPort: 8080, Weight: 1}},
+		},
+	}
+	reconcileIngress(t, r, "web")
+
+	rules, err := r.listAllLoxiModels(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{testRuleKey(80, "a.example.com"): {"10.0.0.1:8080", "10.0.0.2:8080"}}
+	if len(rules) != 1 || fmt.Sprint(lb.endpoints()) != fmt.Sprint(want) {
+		t.Errorf("rules = %v, want only the canonical rule %v", rules, want)
+	}
+}
+
+func TestReconcileBlueGreenCutover(t *testing.T) {
+	ingress := testIngress("web", map[string]string{
+		pkg.ActiveColorAnnotation:  "blue",
+		pkg.BlueBackendAnnotation:  "blue",
+		pkg.GreenBackendAnnotation: "green",
+	}, testRule("a.example.com", map[string]string{"/": "blue"}))
+	r, lb := newTestReconciler(t, testFixtures(ingress,
+		testService("blue"), testEndpoints("blue", "10.0.5.1"),
+		testService("green"), testEndpoints("green", "10.0.6.1"))...)
+	reconcileIngress(t, r, "web")
+
+	key := testRuleKey(80, "a.example.com")
+	r.LoadBalancerAPI = &emptyRuleWatcher{fakeLoadBalancerAPI: lb, t: t, key: key}
+	steps := []struct {
+		color string
+		want  []string
+	}{
+		{color: "green", want: []string{"10.0.6.1:8080"}},
+		{color: "blue", want: []string{"10.0.5.1:8080"}},
+	}
+	for _, step := range steps {
+		updateObject(t, r, client.ObjectKeyFromObject(ingress), &netv1.Ingress{}, func(ingress *netv1.Ingress) {
+			ingress.Annotations[pkg.ActiveColorAnnotation] = step.color
+		})
+		reconcileIngress(t, r, "web")
+
+		if got := lb.endpoints()[key]; fmt.Sprint(got) != fmt.Sprint(step.want) {
+			t.Errorf("%s: endpoints = %v, want %v", step.color, got, step.want)
+		}
+	}
+}
+
+func TestReconcileMovesExternalIP(t *testing.T) {
+	// an empty IP stands for the default external IP
+	tests := []struct {
+		name   string
+		fromIP string
+		toIP   string
+	}{
+		{name: "from the default", toIP: "10.10.10.3"},
+		{name: "between annotations", fromIP: "10.10.10.2", toIP: "10.10.10.3"},
+		{name: "back to the default", fromIP: "10.10.10.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setExternalIP := func(ingress *netv1.Ingress, ip string) {
+				if ip == "" {
+					delete(ingress.Annotations, pkg.ExternalIPAnnotation)
+					return
+				}
+				if ingress.Annotations == nil {
+					ingress.Annotations = make(map[string]string)
+				}
+				ingress.Annotations[pkg.ExternalIPAnnotation] = ip
+			}
+			externalIP := func(ip string) string {
+				if ip == "" {
+					return testExternalIP
+				}
+				return ip
+			}
+			ruleKey := func(ip string) string {
+				return externalIP(ip) + "|tcp|80|a.example.com"
+			}
+
+			ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+			setExternalIP(ingress, tt.fromIP)
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			reconcileIngress(t, r, "web")
+
+			lb.calls = nil
+			updateObject(t, r, client.ObjectKeyFromObject(ingress), &netv1.Ingress{}, func(ingress *netv1.Ingress) {
+				setExternalIP(ingress, tt.toIP)
+			})
+			reconcileIngress(t, r, "web")
+
+			// the new VIP serves before the old one is removed
+			want := []string{"create " + ruleKey(tt.toIP), "delete " + ruleKey(tt.fromIP)}
+			if fmt.Sprint(lb.calls) != fmt.Sprint(want) {
+				t.Errorf("calls = %q, want %q", lb.calls, want)
+			}
+			if rules := lb.endpoints(); len(rules) != 1 || len(rules[ruleKey(tt.toIP)]) == 0 {
+				t.Errorf("rules = %v, want only %s", rules, ruleKey(tt.toIP))
+			}
+
+			got := &netv1.Ingress{}
+			if err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(ingress), got); err != nil {
+				t.Fatal(err)
+			}
+			if status := got.Status.LoadBalancer.Ingress; len(status) != 1 || status[0].IP != externalIP(tt.toIP) {
+				t.Errorf("status = %+v, want %s", status, externalIP(tt.toIP))
+			}
+		})
+	}
+}
+
+func TestReconcileResyncInterval(t *testing.T) {
+	tests := []struct {
+		name       string
+		interval   string
+		fullResync time.Duration
+		want       time.Duration
+	}{
+		{name: "full resync", fullResync: 5 * time.Minute, want: 5 * time.Minute},
+		{name: "shorter interval", interval: "1s", fullResync: 5 * time.Minute, want: time.Second},
+		{name: "longer interval", interval: "10m", fullResync: 5 * time.Minute, want: 5 * time.Minute},
+		{name: "interval without full resync", interval: "10m", want: 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var annotations map[string]string
+			if tt.interval != "" {
+				annotations = map[string]string{pkg.ResyncIntervalAnnotation: tt.interval}
+			}
+			ingress := testIngress("web", annotations, testRule("a.example.com", map[string]string{"/": "web"}))
+			r, _ := newTestReconciler(t, testFixtures(ingress)...)
+			r.FullResyncPeriod = tt.fullResync
+
+			// with an interval, the unchanged Ingress is not skipped by the next reconcile
+			reconciles := 1
+			if tt.interval != "" {
+				reconciles = 2
+			}
+			for i := 0; i < reconciles; i++ {
+				result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ingress)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.RequeueAfter != tt.want {
+					t.Errorf("reconcile %d: requeue after = %s, want %s", i, result.RequeueAfter, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileCatchAllRuleDiff(t *testing.T) {
+	catchAll := testRule("", map[string]string{"/": "api"})
+	hostRule := testRule("a.example.com", map[string]string{"/": "web"})
+	ingress := testIngress("web", nil, catchAll, hostRule)
+	r, lb := newTestReconciler(t, testFixtures(ingress)...)
+	reconcileIngress(t, r, "web")
+
+	// each step sets the rules of the Ingress; the other rule is left untouched
+	steps := []struct {
+		name      string
+		rules     []netv1.IngressRule
+		wantCalls []string
+	}{
+		{name: "remove the catch-all", rules: []netv1.IngressRule{hostRule}, wantCalls: []string{"delete " + testRuleKey(80, "")}},
+		{name: "add it back", rules: []netv1.IngressRule{catchAll, hostRule}, wantCalls: []string{"create " + testRuleKey(80, "")}},
+		{name: "remove the host rule", rules: []netv1.IngressRule{catchAll}, wantCalls: []string{"delete " + testRuleKey(80, "a.example.com")}},
+	}
+	for _, step := range steps {
+		lb.calls = nil
+		updateObject(t, r, client.ObjectKeyFromObject(ingress), &netv1.Ingress{}, func(ingress *netv1.Ingress) {
+			ingress.Spec.Rules = step.rules
+		})
+		reconcileIngress(t, r, "web")
+
+		if fmt.Sprint(lb.calls) != fmt.Sprint(step.wantCalls) {
+			t.Errorf("%s: calls = %q, want %q", step.name, lb.calls, step.wantCalls)
+		}
+	}
+}
+
+// listCountingLoadBalancerAPI counts the rule listings, which every reconcile not skipped does.
+type listCountingLoadBalancerAPI struct {
+	*fakeLoadBalancerAPI
+	lists int
+}
+
+func (l *listCountingLoadBalancerAPI) List(ctx context.Context) (*loxiapi.LoadBalancerListModel, error) {
+	l.lists++
+	return l.fakeLoadBalancerAPI.List(ctx)
+}
+
+func TestReconcileSkipsUnchangedIngress(t *testing.T) {
+	ingressKey := types.NamespacedName{Namespace: "default", Name: "web"}
+	tests := []struct {
+		name        string
+		change      func(t *testing.T, r *LoxilbIngressReconciler)
+		wantSkipped bool
+	}{
+		{
+			name:        "unchanged",
+			change:      func(t *testing.T, r *LoxilbIngressReconciler) {},
+			wantSkipped: true,
+		},
+		{
+			name: "ingress changed",
+			change: func(t *testing.T, r *LoxilbIngressReconciler) {
+				updateObject(t, r, ingressKey, &netv1.Ingress{}, func(ingress *netv1.Ingress) {
+					ingress.Spec.Rules[0].Host = "b.example.com"
+				})
+			},
+		},
+		{
+			name: "endpoints changed",
+			change: func(t *testing.T, r *LoxilbIngressReconciler) {
+				endpoints := &corev1.Endpoints{}
+				updateObject(t, r, ingressKey, endpoints, func(endpoints *corev1.Endpoints) {
+					endpoints.Subsets = testEndpoints("web", "10.0.0.3").Subsets
+				})
+				r.findIngressesForBackend(context.Background(), endpoints)
+			},
+		},
+		{
+			name: "full resync due",
+			change: func(t *testing.T, r *LoxilbIngressReconciler) {
+				value, _ := r.reconciledVersions.Load(ingressKey)
+				version := value.(reconciledVersion)
+				version.at = version.at.Add(-r.FullResyncPeriod)
+				r.reconciledVersions.Store(ingressKey, version)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			r.FullResyncPeriod = time.Hour
+			counter := &listCountingLoadBalancerAPI{fakeLoadBalancerAPI: lb}
+			r.LoadBalancerAPI = counter
+			reconcileIngress(t, r, "web")
+
+			tt.change(t, r)
+			counter.lists = 0
+			reconcileIngress(t, r, "web")
+			if skipped := counter.lists == 0; skipped != tt.wantSkipped {
+				t.Errorf("reconcile skipped = %t, want %t", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestReconcileRepairsDriftedRule(t *testing.T) {
+	ingressKey := types.NamespacedName{Namespace: "default", Name: "web"}
+	tests := []struct {
+		name       string
+		drift      func(svc *loxiapi.LoadBalancerService)
+		wantRepair bool
+	}{
+		{
+			name:  "no drift",
+			drift: func(svc *loxiapi.LoadBalancerService) {},
+		},
+		{
+			name:       "endpoint selection",
+			drift:      func(svc *loxiapi.LoadBalancerService) { svc.Sel = loxiapi.LbSelHash },
+			wantRepair: true,
+		},
+		{
+			name:       "mode",
+			drift:      func(svc *loxiapi.LoadBalancerService) { svc.Mode = loxiapi.LBModeFullNAT },
+			wantRepair: true,
+		},
+		{
+			name:       "security",
+			drift:      func(svc *loxiapi.LoadBalancerService) { svc.Security = 1 },
+			wantRepair: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			reconcileIngress(t, r, "web")
+			key := testRuleKey(80, "a.example.com")
+			want := lb.rules[key]
+
+			// change the rule out of band, keeping its key and endpoints
+			drifted := lb.rules[key]
+			tt.drift(&drifted.Service)
+			lb.rules[key] = drifted
+			lb.calls = nil
+
+			// an edit of the Ingress that leaves its rules unchanged repairs the drift
+			updateObject(t, r, ingressKey, &netv1.Ingress{}, func(ingress *netv1.Ingress) {
+				ingress.Labels = map[string]string{"edited": "true"}
+			})
+			reconcileIngress(t, r, "web")
+
+			if got := lb.rules[key]; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("rule = %+v, want %+v", got.Service, want.Service)
+			}
+			var wantCalls []string
+			if tt.wantRepair {
+				wantCalls = []string{"delete " + key, "create " + key}
+			}
+			if fmt.Sprint(lb.calls) != fmt.Sprint(wantCalls) {
+				t.Errorf("calls = %q, want %q", lb.calls, wantCalls)
+			}
+		})
+	}
+}
+
+func TestReconcileDeletesRules(t *testing.T) {
+	ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+	r, lb := newTestReconciler(t, testFixtures(ingress)...)
+	reconcileIngress(t, r, "web")
+	if len(lb.endpoints()) != 1 {
+		t.Fatalf("rules = %v, want one", lb.endpoints())
+	}
+
+	ctx := context.Background()
+	if err := r.Client.Delete(ctx, ingress); err != nil {
+		t.Fatal(err)
+	}
+	reconcileIngress(t, r, "web")
+
+	if rules := lb.endpoints(); len(rules) != 0 {
+		t.Errorf("rules = %v, want none", rules)
+	}
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(ingress), &netv1.Ingress{}); err == nil {
+		t.Errorf("ingress still exists, want its finalizer released")
+	}
+}
+
+func TestReconcileFinalizer(t *testing.T) {
+	tests := []struct {
+		name           string
+		finalizer      string
+		existing       []string
+		wantFinalizers []string
+	}{
+		{name: "default", finalizer: DefaultFinalizer, wantFinalizers: []string{DefaultFinalizer}},
+		{name: "custom name", finalizer: "example.com/cleanup", wantFinalizers: []string{"example.com/cleanup"}},
+		{name: "renamed", finalizer: "example.com/cleanup", existing: []string{DefaultFinalizer}, wantFinalizers: []string{"example.com/cleanup"}},
+		{name: "disabled", existing: []string{DefaultFinalizer}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+			ingress.Finalizers = tt.existing
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			r.Finalizer = tt.finalizer
+			reconcileIngress(t, r, "web")
+
+			got := &netv1.Ingress{}
+			if err := r.Client.Get(ctx, client.ObjectKeyFromObject(ingress), got); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got.Finalizers) != fmt.Sprint(tt.wantFinalizers) {
+				t.Errorf("finalizers = %v, want %v", got.Finalizers, tt.wantFinalizers)
+			}
+
+			// with a finalizer the rules are deleted before the Ingress is released, without once it is gone
+			if err := r.Client.Delete(ctx, got); err != nil {
+				t.Fatal(err)
+			}
+			reconcileIngress(t, r, "web")
+			if rules := lb.endpoints(); len(rules) != 0 {
+				t.Errorf("rules = %v, want none", rules)
+			}
+			if err := r.Client.Get(ctx, client.ObjectKeyFromObject(ingress), &netv1.Ingress{}); !apierrors.IsNotFound(err) {
+				t.Errorf("get ingress error = %v, want it deleted", err)
+			}
+		})
+	}
+}
+
+func TestReconcileDeletionGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+	r, lb := newTestReconciler(t, testFixtures(ingress.DeepCopy())...)
+	r.Finalizer = ""
+	r.DeletionGracePeriod = time.Hour
+	reconcileIngress(t, r, "web")
+
+	if err := r.Client.Delete(ctx, ingress); err != nil {
+		t.Fatal(err)
+	}
+	reconcileIngress(t, r, "web")
+	if rules := lb.endpoints(); len(rules) != 1 {
+		t.Fatalf("rules = %v, want them kept during the grace period", rules)
+	}
+
+	// the recreated Ingress takes the rules back, and the pending deletion is dropped
+	if err := r.Client.Create(ctx, testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))); err != nil {
+		t.Fatal(err)
+	}
+	reconcileIngress(t, r, "web")
+	if _, isok := r.pendingDeletions.Load(client.ObjectKeyFromObject(ingress)); isok {
+		t.Errorf("deletion still pending after the Ingress was recreated")
+	}
+	want := []string{"10.0.0.1:8080", "10.0.0.2:8080"}
+	if got := lb.endpoints()[testRuleKey(80, "a.example.com")]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("endpoints = %v, want %v", got, want)
+	}
+}
+
+func TestReconcileMigratesLegacyRuleNames(t *testing.T) {
+	ctx := context.Background()
+	ingress := testIngress("web", nil,
+		testRule("a.example.com", map[string]string{"/": "web"}),
+		testRule("b.example.com", map[string]string{"/": "web"}))
+	r, lb := newTestReconciler(t, testFixtures(ingress)...)
+	for _, host := range []string{"a.example.com", "old.example.com"} {
+		model := &loxiapi.LoadBalancerModel{
+			Service:   r.createLoxiLoadBalancerService("default", "web", testExternalIP, 0, host, 0),
+			Endpoints: []loxiapi.LoadBalancerEndpoint{{EndpointIP: "10.0.0.1", TargetPort: 8080, Weight: 1}},
+		}
+		if err := lb.Create(ctx, model); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lb.calls = nil
+
+	r.RuleNamePrefix = "ingctl-"
+	reconcileIngress(t, r, "web")
+
+	want := []string{testRuleKey(80, "a.example.com"), testRuleKey(80, "b.example.com")}
+	got := make([]string, 0)
+	for key, model := range lb.rules {
+		if model.Service.Name != "ingctl-default_web" {
+			t.Errorf("rule %s named %q, want ingctl-default_web", key, model.Service.Name)
+		}
+		got = append(got, key)
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("rules = %v, want %v", got, want)
+	}
+
+	// the legacy rule no longer desired is deleted only once the new rule serves
+	created := slices.Index(lb.calls, "create "+testRuleKey(80, "b.example.com"))
+	deleted := slices.Index(lb.calls, "delete "+testRuleKey(80, "old.example.com"))
+	if created < 0 || deleted < created {
+		t.Errorf("calls = %q, want the new rule created before the legacy one is deleted", lb.calls)
+	}
+}
+
+func TestReconcileIgnoresOtherClass(t *testing.T) {
+	other := &netv1.IngressClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx"},
+		Spec:       netv1.IngressClassSpec{Controller: "k8s.io/ingress-nginx"},
+	}
+	ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+	className := "nginx"
+	ingress.Spec.IngressClassName = &className
+	r, lb := newTestReconciler(t, testFixtures(other, ingress)...)
+	reconcileIngress(t, r, "web")
+
+	if rules := lb.endpoints(); len(rules) != 0 {
+		t.Errorf("rules = %v, want none", rules)
+	}
+}
+
+// updateObject gets the object of key, changes it with update and writes it back.
+func updateObject[T client.Object](t *testing.T, r *LoxilbIngressReconciler, key types.NamespacedName, obj T, update func(T)) {
+	t.Helper()
+
+	ctx := context.Background()
+	if err := r.Client.Get(ctx, key, obj); err != nil {
+		t.Fatal(err)
+	}
+	update(obj)
+	if err := r.Client.Update(ctx, obj); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconcileUnprogramsIngress(t *testing.T) {
+	ingressKey := types.NamespacedName{Namespace: "default", Name: "web"}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		setup       func(t *testing.T, r *LoxilbIngressReconciler)
+		change      func(t *testing.T, r *LoxilbIngressReconciler)
+	}{
+		{
+			name:        "opt-in removed",
+			annotations: map[string]string{pkg.EnabledAnnotation: "true"},
+			setup:       func(_ *testing.T, r *LoxilbIngressReconciler) { r.RequireOptIn = true },
+			change: func(t *testing.T, r *LoxilbIngressReconciler) {
+				updateObject(t, r, ingressKey, &netv1.Ingress{}, func(ingress *netv1.Ingress) {
+					delete(ingress.Annotations, pkg.EnabledAnnotation)
+				})
+			},
+		},
+		{
+			name: "namespace unselected",
+			setup: func(t *testing.T, r *LoxilbIngressReconciler) {
+				r.NamespaceSelector = labels.SelectorFromSet(labels.Set{"loxilb": "enabled"})
+				updateObject(t, r, types.NamespacedName{Name: "default"}, &corev1.Namespace{}, func(ns *corev1.Namespace) {
+					ns.Labels = map[string]string{"loxilb": "enabled"}
+				})
+			},
+			change: func(t *testing.T, r *LoxilbIngressReconciler) {
+				updateObject(t, r, types.NamespacedName{Name: "default"}, &corev1.Namespace{}, func(ns *corev1.Namespace) {
+					ns.Labels = nil
+				})
+			},
+		},
+		{
+			name: "class handed off",
+			change: func(t *testing.T, r *LoxilbIngressReconciler) {
+				other := &netv1.IngressClass{
+					ObjectMeta: metav1.ObjectMeta{Name: "nginx"},
+					Spec:       netv1.IngressClassSpec{Controller: "k8s.io/ingress-nginx"},
+				}
+				if err := r.Client.Create(context.Background(), other); err != nil {
+					t.Fatal(err)
+				}
+				updateObject(t, r, ingressKey, &netv1.Ingress{}, func(ingress *netv1.Ingress) {
+					ingress.Spec.IngressClassName = &other.Name
+				})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", tt.annotations, testRule("a.example.com", map[string]string{"/": "web"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			if tt.setup != nil {
+				tt.setup(t, r)
+			}
+			reconcileIngress(t, r, "web")
+			if len(lb.endpoints()) != 1 {
+				t.Fatalf("rules = %v, want one", lb.endpoints())
+			}
+
+			tt.change(t, r)
+			reconcileIngress(t, r, "web")
+
+			if rules := lb.endpoints(); len(rules) != 0 {
+				t.Errorf("rules = %v, want none", rules)
+			}
+			got := &netv1.Ingress{}
+			if err := r.Client.Get(context.Background(), ingressKey, got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Status.LoadBalancer.Ingress) != 0 {
+				t.Errorf("status = %+v, want it cleared", got.Status.LoadBalancer)
+			}
+			if len(got.Finalizers) != 0 {
+				t.Errorf("finalizers = %v, want none", got.Finalizers)
+			}
+		})
+	}
+}
+
+func TestReconcileExpiresRules(t *testing.T) {
+	ingress := testIngress("web", map[string]string{pkg.RuleTTLAnnotation: "1h"},
+		testRule("a.example.com", map[string]string{"/": "web"}))
+	ingress.CreationTimestamp = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	ingress.Status.LoadBalancer.Ingress = []netv1.IngressLoadBalancerIngress{{IP: testExternalIP}}
+	r, lb := newTestReconciler(t, testFixtures(ingress)...)
+	model := &loxiapi.LoadBalancerModel{
+		Service: r.createLoxiLoadBalancerService("default", "web", testExternalIP, 0, "a.example.com", 0),
+	}
+	if err := lb.Create(context.Background(), model); err != nil {
+		t.Fatal(err)
+	}
+
+	reconcileIngress(t, r, "web")
+	if rules := lb.endpoints(); len(rules) != 0 {
+		t.Errorf("rules = %v, want them expired", rules)
+	}
+	got := &netv1.Ingress{}
+	if err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(ingress), got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Status.LoadBalancer.Ingress) != 0 {
+		t.Errorf("status = %+v, want it cleared", got.Status.LoadBalancer)
+	}
+
+	// later reconciles do not delete the rules again
+	reconcileIngress(t, r, "web")
+	if events := drainEvents(r); strings.Count(events, "RuleExpired") != 1 {
+		t.Errorf("events = %q, want one RuleExpired", events)
+	}
+}
+
+func TestReconcileIngressLimits(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxRules     int
+		maxEndpoints int
+		wantRefused  bool
+	}{
+		{name: "rules at limit", maxRules: 2},
+		{name: "rules above limit", maxRules: 1, wantRefused: true},
+		{name: "endpoints at limit", maxEndpoints: 4},
+		{name: "endpoints above limit", maxEndpoints: 3, wantRefused: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("web", nil,
+				testRule("a.example.com", map[string]string{"/": "web"}),
+				testRule("b.example.com", map[string]string{"/": "web"}))
+			r, lb := newTestReconciler(t, testFixtures(ingress)...)
+			r.MaxRulesPerIngress = tt.maxRules
+			r.MaxEndpointsPerIngress = tt.maxEndpoints
+
+			_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ingress)})
+			var limitErr *IngressLimitExceededError
+			if errors.As(err, &limitErr) != tt.wantRefused {
+				t.Fatalf("reconcile error = %v, want refused %t", err, tt.wantRefused)
+			}
+
+			got := &netv1.Ingress{}
+			if err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(ingress), got); err != nil {
+				t.Fatal(err)
+			}
+			ports := got.Status.LoadBalancer.Ingress[0].Ports
+			if len(ports) != 1 {
+				t.Fatalf("status ports = %+v, want one", ports)
+			}
+			if !tt.wantRefused {
+				if rules := lb.endpoints(); len(rules) != 2 || ports[0].Error != nil {
+					t.Errorf("rules = %v, status ports = %+v, want the ingress programmed", rules, ports)
+				}
+				return
+			}
+			if rules := lb.endpoints(); len(rules) != 0 {
+				t.Errorf("rules = %v, want none", rules)
+			}
+			if ports[0].Error == nil || *ports[0].Error != ingressLimitExceededStatusError {
+				t.Errorf("status ports = %+v, want error %s", ports, ingressLimitExceededStatusError)
+			}
+			if events := drainEvents(r); !strings.Contains(events, "IngressLimitExceeded") || !strings.Contains(events, limitErr.Limit) {
+				t.Errorf("events = %q, want IngressLimitExceeded naming the %s limit", events, limitErr.Limit)
+			}
+		})
+	}
+}
+
+func TestReconcileKeepsRulesOnNamespaceError(t *testing.T) {
+	ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+	r, lb := newTestReconciler(t, testFixtures(ingress)...)
+	reconcileIngress(t, r, "web")
+
+	r.Client = interceptor.NewClient(r.Client.(client.WithWatch), interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			if _, isok := obj.(*corev1.Namespace); isok {
+				return errors.New("connection refused")
+			}
+			return c.Get(ctx, key, obj, opts...)
+		},
+	})
+	_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(ingress)})
+	if err == nil {
+		t.Errorf("reconcile succeeded, want the namespace error to requeue")
+	}
+	if rules := lb.endpoints(); len(rules) != 1 {
+		t.Errorf("rules = %v, want them kept", rules)
+	}
+}
+
+func TestReconcileIngressClassDefaults(t *testing.T) {
+	namespace := "kube-system"
+	class := &netv1.IngressClass{
+		ObjectMeta: metav1.ObjectMeta{Name: testIngressClass},
+		Spec: netv1.IngressClassSpec{
+			Controller: testClassController,
+			Parameters: &netv1.IngressClassParametersReference{
+				Kind:      "ConfigMap",
+				Name:      "loxilb-defaults",
+				Namespace: &namespace,
+				Scope:     ptrTo(netv1.IngressClassParametersReferenceScopeNamespace),
+			},
+		},
+	}
+	defaults := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "loxilb-defaults"},
+		Data:       map[string]string{pkg.MaintenanceBackendAnnotation: "api"},
+	}
+	ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "empty"}))
+	objs := []client.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		class, defaults, ingress,
+		testService("empty"), testEndpoints("empty"),
+		testService("api"), testEndpoints("api", "10.0.1.1"),
+	}
+	r, lb := newTestReconciler(t, objs...)
+	reconcileIngress(t, r, "web")
+
+	want := []string{"10.0.1.1:8080"}
+	if got := lb.endpoints()[testRuleKey(80, "a.example.com")]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("endpoints = %v, want the maintenance backend %v", got, want)
+	}
+
+	// a change of the defaults requeues the Ingresses of the class, from the ConfigMap metadata
+	changed := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "loxilb-defaults"}}
+	if requests := r.findIngressesForParameters(context.Background(), changed); len(requests) != 1 {
+		t.Errorf("requests = %v, want the ingress", requests)
+	}
+	other := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "other"}}
+	if requests := r.findIngressesForParameters(context.Background(), other); len(requests) != 0 {
+		t.Errorf("requests = %v, want none for an unreferenced ConfigMap", requests)
+	}
+}
+
+func TestReconcileMissingIngressClassParameters(t *testing.T) {
+	namespace := "kube-system"
+	class := &netv1.IngressClass{
+		ObjectMeta: metav1.ObjectMeta{Name: testIngressClass},
+		Spec: netv1.IngressClassSpec{
+			Controller: testClassController,
+			Parameters: &netv1.IngressClassParametersReference{
+				Kind:      "ConfigMap",
+				Name:      "loxilb-defaults",
+				Namespace: &namespace,
+				Scope:     ptrTo(netv1.IngressClassParametersReferenceScopeNamespace),
+			},
+		},
+	}
+	ingress := testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"}))
+	objs := []client.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		class, ingress, testService("web"), testEndpoints("web", "10.0.0.1"),
+	}
+	r, lb := newTestReconciler(t, objs...)
+	reconcileIngress(t, r, "web")
+
+	want := []string{"10.0.0.1:8080"}
+	if got := lb.endpoints()[testRuleKey(80, "a.example.com")]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("endpoints = %v, want %v without defaults", got, want)
+	}
+	if events := drainEvents(r); !strings.Contains(events, "IngressClassParametersNotFound") {
+		t.Errorf("events = %q, want IngressClassParametersNotFound", events)
+	}
+}
+
+// drainEvents returns the events recorded so far by the fake recorder of r.
+func drainEvents(r *LoxilbIngressReconciler) string {
+	recorder := r.Recorder.(*record.FakeRecorder)
+	events := make([]string, 0)
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return strings.Join(events, "\n")
+		}
+	}
+}
+
+func ptrTo[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"loxilb.io/loxilb-ingress-manager/pkg"
+
+	loxiapi "github.com/loxilb-io/kube-loxilb/pkg/api"
+)
+
+// getIngressLoadBalancerStatus returns the status of an Ingress programmed with models:
+// one entry per external IP, listing the ports and protocols of the rules on it.
+func getIngressLoadBalancerStatus(models []loxiapi.LoadBalancerModel) netv1.IngressLoadBalancerStatus {
+	ports := make(map[string][]netv1.IngressPortStatus)
+	ips := make([]string, 0)
+	for _, model := range models {
+		ip := model.Service.ExternalIP
+		if _, isok := ports[ip]; !isok {
+			ips = append(ips, ip)
+		}
+
+		portStatus := netv1.IngressPortStatus{
+			Port:     int32(model.Service.Port),
+			Protocol: corev1.Protocol(strings.ToUpper(model.Service.Protocol)),
+		}
+		if !hasIngressPortStatus(ports[ip], portStatus) {
+			ports[ip] = append(ports[ip], portStatus)
+		}
+	}
+	sort.Strings(ips)
+
+	status := netv1.IngressLoadBalancerStatus{}
+	for _, ip := range ips {
+		sort.Slice(ports[ip], func(i, j int) bool {
+			return ports[ip][i].Port < ports[ip][j].Port
+		})
+		status.Ingress = append(status.Ingress, netv1.IngressLoadBalancerIngress{IP: ip, Ports: ports[ip]})
+	}
+	return status
+}
+
+func hasIngressPortStatus(ports []netv1.IngressPortStatus, port netv1.IngressPortStatus) bool {
+	for _, p := range ports {
+		if p.Port == port.Port && p.Protocol == port.Protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// updateIngressStatus reports the external IPs and ports the Ingress is served on, as
+// programmed in loxilb, in its status.
+func (r *LoxilbIngressReconciler) updateIngressStatus(ctx context.Context, ingress *netv1.Ingress, models []loxiapi.LoadBalancerModel) error {
+	status := getIngressLoadBalancerStatus(models)
+	if equality.Semantic.DeepEqual(ingress.Status.LoadBalancer, status) {
+		return nil
+	}
+
+	patch := client.MergeFrom(ingress.DeepCopy())
+	ingress.Status.LoadBalancer = status
+	return r.Client.Status().Patch(ctx, ingress, patch)
+}
+
+// ingressLimitExceededStatusError is the status error of the ports of an Ingress refused
+// for exceeding the rule or endpoint limits.
+const ingressLimitExceededStatusError = "loxilb.io/IngressLimitExceeded"
+
+// setIngressErrorStatus reports the ports the Ingress would be served on with statusError
+// in its status, when it is refused rather than programmed, unless its status is left alone.
+func (r *LoxilbIngressReconciler) setIngressErrorStatus(ctx context.Context, ingress *netv1.Ingress, models []loxiapi.LoadBalancerModel, statusError string) error {
+	if skip, _ := strconv.ParseBool(ingress.Annotations[pkg.SkipStatusUpdateAnnotation]); skip || r.SkipStatusUpdate {
+		return nil
+	}
+
+	status := getIngressLoadBalancerStatus(models)
+	for i := range status.Ingress {
+		for j := range status.Ingress[i].Ports {
+			status.Ingress[i].Ports[j].Error = &statusError
+		}
+	}
+	if equality.Semantic.DeepEqual(ingress.Status.LoadBalancer, status) {
+		return nil
+	}
+
+	patch := client.MergeFrom(ingress.DeepCopy())
+	ingress.Status.LoadBalancer = status
+	return r.Client.Status().Patch(ctx, ingress, patch)
+}
+
+// clearIngressStatus removes the addresses from the status of an Ingress whose rules were
+// deleted, unless its status is left alone.
+func (r *LoxilbIngressReconciler) clearIngressStatus(ctx context.Context, ingress *netv1.Ingress) error {
+	if skip, _ := strconv.ParseBool(ingress.Annotations[pkg.SkipStatusUpdateAnnotation]); skip || r.SkipStatusUpdate {
+		return nil
+	}
+	return r.updateIngressStatus(ctx, ingress, nil)
+}
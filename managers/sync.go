@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// initialSync enqueues every existing Ingress into the controller once the caches are synced,
+// and waits until each was reconciled, so that a restarted controller reprograms loxilb
+// before its readiness check passes. The requests go through the controller workqueue, so
+// an Ingress is never reconciled by two workers at once. With leader election, only the
+// leader programs loxilb: standby replicas are ready as is, and the sync starts once elected.
+type initialSync struct {
+	reconciler *LoxilbIngressReconciler
+	timeout    time.Duration
+	elected    <-chan struct{}
+	events     chan event.GenericEvent
+	done       atomic.Bool
+
+	mu       sync.Mutex
+	pending  map[types.NamespacedName]struct{}
+	finished chan struct{}
+}
+
+func newInitialSync(reconciler *LoxilbIngressReconciler, timeout time.Duration, elected <-chan struct{}) *initialSync {
+	return &initialSync{
+		reconciler: reconciler,
+		timeout:    timeout,
+		elected:    elected,
+		events:     make(chan event.GenericEvent),
+		finished:   make(chan struct{}),
+	}
+}
+
+// NeedLeaderElection lets standby replicas run the sync, so they report ready.
+func (s *initialSync) NeedLeaderElection() bool {
+	return false
+}
+
+// Source feeds the Ingresses to sync into the controller.
+func (s *initialSync) Source() source.Source {
+	return source.Channel(s.events, &handler.EnqueueRequestForObject{})
+}
+
+func (s *initialSync) Start(ctx context.Context) error {
+	defer s.done.Store(true)
+
+	select {
+	case <-s.elected:
+	case <-ctx.Done():
+		return nil
+	}
+
+	logger := log.FromContext(ctx).WithName("initial-sync")
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	ingressList := &netv1.IngressList{}
+	if err := s.reconciler.Client.List(ctx, ingressList); err != nil {
+		logger.Error(err, "failed to list ingresses")
+		return nil
+	}
+
+	s.mu.Lock()
+	s.pending = make(map[types.NamespacedName]struct{}, len(ingressList.Items))
+	for _, ingress := range ingressList.Items {
+		s.pending[client.ObjectKeyFromObject(&ingress)] = struct{}{}
+	}
+	if len(s.pending) == 0 {
+		close(s.finished)
+	}
+	s.mu.Unlock()
+
+	for i := range ingressList.Items {
+		select {
+		case s.events <- event.GenericEvent{Object: &ingressList.Items[i]}:
+		case <-ctx.Done():
+			logger.Info("initial sync timed out", "timeout", s.timeout)
+			return nil
+		}
+	}
+
+	select {
+	case <-s.finished:
+		logger.Info("initial sync done", "ingresses", len(ingressList.Items))
+	case <-ctx.Done():
+		logger.Info("initial sync timed out", "timeout", s.timeout)
+	}
+	return nil
+}
+
+// reconciled records that the Ingress key went through a reconcile, whatever its outcome.
+func (s *initialSync) reconciled(key types.NamespacedName) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, isok := s.pending[key]; !isok {
+		return
+	}
+	delete(s.pending, key)
+	if len(s.pending) == 0 {
+		close(s.finished)
+	}
+}
+
+// Check is a readiness check failing until the initial sync finished or timed out. Replicas
+// that are not the leader have nothing to sync.
+func (s *initialSync) Check(_ *http.Request) error {
+	select {
+	case <-s.elected:
+	default:
+		return nil
+	}
+	if !s.done.Load() {
+		return errors.New("initial ingress sync in progress")
+	}
+	return nil
+}
+
+// shutdownCleanupTimeout bounds the deletion of owned rules at shutdown. It stays below
+// the default graceful shutdown timeout of the manager.
+const shutdownCleanupTimeout = 20 * time.Second
+
+// shutdownCleanup deletes every loxilb rule owned by this controller when the manager stops.
+// It is only meant for ephemeral deployments: a rolling restart would drop live rules.
+type shutdownCleanup struct {
+	reconciler *LoxilbIngressReconciler
+}
+
+func (c *shutdownCleanup) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	logger := log.FromContext(ctx).WithName("shutdown-cleanup")
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), shutdownCleanupTimeout)
+	defer cancel()
+
+	c.reconciler.ownedRules.Range(func(key, _ any) bool {
+		ruleName := key.(string)
+		err := c.reconciler.deleteLoxiModelsByName(cleanupCtx, ruleName)
+		for isLoxiRateLimited(err) && cleanupCtx.Err() == nil {
+			time.Sleep(10 * time.Millisecond)
+			err = c.reconciler.deleteLoxiModelsByName(cleanupCtx, ruleName)
+		}
+		if err != nil {
+			logger.Error(err, "failed to delete loxilb-ingress rule "+ruleName)
+		} else {
+			logger.Info("deleted loxilb-ingress rule", "name", ruleName)
+		}
+		return cleanupCtx.Err() == nil
+	})
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	loxiapi "github.com/loxilb-io/kube-loxilb/pkg/api"
+)
+
+func TestInitialSync(t *testing.T) {
+	tests := []struct {
+		name      string
+		elected   bool
+		reconcile bool
+		timeout   time.Duration
+		want      []string
+	}{
+		{name: "all reconciled", elected: true, reconcile: true, want: []string{"default/api", "default/web"}},
+		{name: "timed out", elected: true, timeout: 100 * time.Millisecond, want: []string{"default/api", "default/web"}},
+		{name: "standby replica"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestReconciler(t, testFixtures(
+				testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"})),
+				testIngress("api", nil, testRule("b.example.com", map[string]string{"/": "api"})))...)
+			elected := make(chan struct{})
+			if tt.elected {
+				close(elected)
+			}
+			s := newInitialSync(r, tt.timeout, elected)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				_ = s.Start(ctx)
+				close(done)
+			}()
+
+			got := make([]string, 0)
+			for range tt.want {
+				object := (<-s.events).Object
+				if err := s.Check(nil); err == nil {
+					t.Errorf("ready while %s is not reconciled", object.GetName())
+				}
+				got = append(got, client.ObjectKeyFromObject(object).String())
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("enqueued = %v, want %v", got, tt.want)
+			}
+
+			if tt.reconcile {
+				for _, key := range got {
+					namespace, name, _ := strings.Cut(key, "/")
+					s.reconciled(types.NamespacedName{Namespace: namespace, Name: name})
+				}
+			}
+			if !tt.elected {
+				cancel()
+			}
+			<-done
+			if err := s.Check(nil); err != nil {
+				t.Errorf("not ready after the initial sync: %v", err)
+			}
+		})
+	}
+}
+
+func TestShutdownCleanup(t *testing.T) {
+	r, lb := newTestReconciler(t, testFixtures(
+		testIngress("web", nil, testRule("a.example.com", map[string]string{"/": "web"})),
+		testIngress("api", nil, testRule("b.example.com", map[string]string{"/": "api"})))...)
+	reconcileIngress(t, r, "web")
+	reconcileIngress(t, r, "api")
+	other := &loxiapi.LoadBalancerModel{
+		Service: r.createLoxiLoadBalancerService("default", "other", testExternalIP, 0, "c.example.com", 0),
+	}
+	if err := lb.Create(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := (&shutdownCleanup{reconciler: r}).Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rules of other controllers are left alone
+	want := map[string][]string{testRuleKey(80, "c.example.com"): {}}
+	if got := lb.endpoints(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("rules = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+
+	"loxilb.io/loxilb-ingress-manager/pkg"
+
+	loxiapi "github.com/loxilb-io/kube-loxilb/pkg/api"
+)
+
+// ValidateOptions are the controller settings the validation programs the rules with, as
+// the fields of the same name of LoxilbIngressReconciler.
+type ValidateOptions struct {
+	ExternalIP             string
+	ExternalIPv6           string
+	RuleNamePrefix         string
+	NginxCompat            bool
+	MaxRulesPerIngress     int
+	MaxEndpointsPerIngress int
+	MaxEndpointsPerRule    int
+}
+
+// ValidateManifests runs the configuration, annotation parsing, model building and limit
+// checks of Reconcile offline on the Ingresses of manifests, a multi-document YAML stream.
+// The Services, Endpoints, IngressClasses and ConfigMaps the Ingresses refer to are looked
+// up in manifests too. Errors, warning events and the models that would be programmed with
+// options are written to out. It reports whether every Ingress is valid.
+func ValidateManifests(ctx context.Context, scheme *runtime.Scheme, manifests []byte, options ValidateOptions, out io.Writer) (bool, error) {
+	decoder := serializer.NewCodecFactory(scheme).UniversalDeserializer()
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(manifests)))
+
+	objs := make([]client.Object, 0)
+	ingresses := make([]*netv1.Ingress, 0)
+	for {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		obj, _, err := decoder.Decode(doc, nil, nil)
+		if err != nil {
+			return false, err
+		}
+		clientObj, isok := obj.(client.Object)
+		if !isok {
+			continue
+		}
+		if _, isNamespace := obj.(*corev1.Namespace); !isNamespace && clientObj.GetNamespace() == "" {
+			clientObj.SetNamespace("default")
+		}
+		objs = append(objs, clientObj)
+		if ingress, isok := obj.(*netv1.Ingress); isok {
+			ingresses = append(ingresses, ingress)
+		}
+	}
+
+	r := &LoxilbIngressReconciler{
+		Client:                 &manifestReader{scheme: scheme, objs: objs},
+		Scheme:                 scheme,
+		Recorder:               &manifestRecorder{out: out},
+		LoxiClient:             &loxiapi.LoxiClient{Host: options.ExternalIP},
+		ExternalIPv6:           options.ExternalIPv6,
+		RuleNamePrefix:         options.RuleNamePrefix,
+		NginxCompat:            options.NginxCompat,
+		MaxRulesPerIngress:     options.MaxRulesPerIngress,
+		MaxEndpointsPerIngress: options.MaxEndpointsPerIngress,
+		MaxEndpointsPerRule:    options.MaxEndpointsPerRule,
+	}
+
+	valid := true
+	for _, ingress := range ingresses {
+		fmt.Fprintf(out, "# ingress %s/%s\n", ingress.Namespace, ingress.Name)
+		if err := r.validateIngress(ctx, ingress, out); err != nil {
+			fmt.Fprintf(out, "error: %s\n", err)
+			valid = false
+		}
+	}
+	return valid, nil
+}
+
+func (r *LoxilbIngressReconciler) validateIngress(ctx context.Context, ingress *netv1.Ingress, out io.Writer) error {
+	ingress, mappings, err := r.configureIngress(ctx, ingress)
+	if err != nil {
+		return err
+	}
+	for _, mapping := range mappings {
+		fmt.Fprintf(out, "nginx annotation: %s\n", mapping)
+	}
+
+	config, err := pkg.ParseIngressConfig(ingress)
+	if err != nil {
+		return err
+	}
+
+	r.warnOrphanTLSHosts(ingress)
+	models, err := r.createLoxiModelList(ctx, ingress, &config)
+	if err != nil {
+		return err
+	}
+	if err := r.checkIngressLimits(ingress, models); err != nil {
+		return err
+	}
+
+	keys, merged := mergeLoxiModels(models)
+	for _, key := range keys {
+		data, err := yaml.Marshal(merged[key])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "rule %s:\n%s", key, data)
+	}
+	return nil
+}
+
+// manifestReader serves Get and List from the objects of the validated manifests. The
+// validation only reads, so the other methods of client.Client are left unimplemented.
+type manifestReader struct {
+	client.Client
+	scheme *runtime.Scheme
+	objs   []client.Object
+}
+
+func (m *manifestReader) Get(_ context.Context, key client.ObjectKey, obj client.Object, _ ...client.GetOption) error {
+	gvk, err := apiutil.GVKForObject(obj, m.scheme)
+	if err != nil {
+		return err
+	}
+	for _, manifest := range m.objs {
+		manifestGVK, err := apiutil.GVKForObject(manifest, m.scheme)
+		if err != nil || manifestGVK != gvk {
+			continue
+		}
+		if manifest.GetNamespace() == key.Namespace && manifest.GetName() == key.Name {
+			reflect.ValueOf(obj).Elem().Set(reflect.ValueOf(manifest.DeepCopyObject()).Elem())
+			return nil
+		}
+	}
+	return apierrors.NewNotFound(schema.GroupResource{Group: gvk.Group, Resource: strings.ToLower(gvk.Kind)}, key.Name)
+}
+
+func (m *manifestReader) List(_ context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOptions := &client.ListOptions{}
+	listOptions.ApplyOptions(opts)
+	if listOptions.FieldSelector != nil && !listOptions.FieldSelector.Empty() {
+		return fmt.Errorf("field selector %s not supported offline", listOptions.FieldSelector)
+	}
+
+	gvk, err := apiutil.GVKForObject(list, m.scheme)
+	if err != nil {
+		return err
+	}
+	gvk.Kind = strings.TrimSuffix(gvk.Kind, "List")
+
+	items := make([]runtime.Object, 0)
+	for _, manifest := range m.objs {
+		manifestGVK, err := apiutil.GVKForObject(manifest, m.scheme)
+		if err != nil || manifestGVK != gvk {
+			continue
+		}
+		if listOptions.Namespace != "" && manifest.GetNamespace() != listOptions.Namespace {
+			continue
+		}
+		if listOptions.LabelSelector != nil && !listOptions.LabelSelector.Matches(labels.Set(manifest.GetLabels())) {
+			continue
+		}
+		items = append(items, manifest.DeepCopyObject())
+	}
+	return meta.SetList(list, items)
+}
+
+// manifestRecorder writes the events of the validation to out, in the format of
+// record.FakeRecorder.
+type manifestRecorder struct {
+	out io.Writer
+}
+
+func (m *manifestRecorder) Event(_ runtime.Object, eventtype, reason, message string) {
+	fmt.Fprintf(m.out, "event: %s %s %s\n", eventtype, reason, message)
+}
+
+func (m *manifestRecorder) Eventf(obj runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	m.Event(obj, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (m *manifestRecorder) AnnotatedEventf(obj runtime.Object, _ map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	m.Eventf(obj, eventtype, reason, messageFmt, args...)
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+)
+
+const testBackendManifests = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - name: http
+    port: 80
+    targetPort: 8080
+---
+apiVersion: v1
+kind: Endpoints
+metadata:
+  name: web
+subsets:
+- addresses:
+  - ip: 10.0.0.1
+  ports:
+  - name: http
+    port: 8080
+`
+
+func testIngressManifest(annotations, tls string) string {
+	return fmt.Sprintf(`---
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: web
+  annotations: {%s}
+spec:
+  tls: [%s]
+  rules:
+  - host: a.example.com
+    http:
+      paths:
+      - path: /
+        pathType: Prefix
+        backend:
+          service:
+            name: web
+            port:
+              number: 80
+`, annotations, tls)
+}
+
+func TestValidateManifests(t *testing.T) {
+	// more orphan TLS hosts than the 100 events a record.FakeRecorder buffers
+	orphanHosts := make([]string, 0, 150)
+	for i := 0; i < 150; i++ {
+		orphanHosts = append(orphanHosts, fmt.Sprintf("{hosts: [h%d.example.com]}", i))
+	}
+
+	tests := []struct {
+		name      string
+		manifests string
+		wantValid bool
+		want      []string
+	}{
+		{
+			name:      "valid",
+			manifests: testBackendManifests + testIngressManifest("", ""),
+			wantValid: true,
+			want:      []string{"rule 10.10.10.1|tcp|80|a.example.com:", "endpointIP: 10.0.0.1", "targetPort: 8080"},
+		},
+		{
+			name:      "invalid annotation",
+			manifests: testBackendManifests + testIngressManifest(`"loxilb.io/epselect": "fastest"`, ""),
+			want:      []string{"error: ", "loxilb.io/epselect"},
+		},
+		{
+			name:      "missing backend",
+			manifests: testIngressManifest("", ""),
+			want:      []string{"error: ", `"web" not found`},
+		},
+		{
+			name:      "many events",
+			manifests: testBackendManifests + testIngressManifest("", strings.Join(orphanHosts, ", ")),
+			wantValid: true,
+			want:      []string{"event: Warning OrphanTLSHost TLS host h149.example.com is not used by any rule"},
+		},
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			valid, err := ValidateManifests(context.Background(), scheme, []byte(tt.manifests),
+				ValidateOptions{ExternalIP: testExternalIP}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if valid != tt.wantValid {
+				t.Errorf("valid = %t, want %t", valid, tt.wantValid)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("output does not contain %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"loxilb.io/loxilb-ingress-manager/pkg"
+)
+
+const (
+	// backendServiceIndexKey indexes Ingresses by the "namespace/name" of every service they route to.
+	backendServiceIndexKey = "spec.rules.backend.service"
+)
+
+func (r *LoxilbIngressReconciler) indexIngressBackendServices(obj client.Object) []string {
+	ingress, isok := obj.(*netv1.Ingress)
+	if !isok {
+		return nil
+	}
+	return r.getIngressBackendServices(ingress)
+}
+
+// getIngressBackendServices returns the "namespace/name" of every service the Ingress routes
+// to, as set by its spec and annotations. The defaults of its IngressClass are not indexed:
+// indexing runs without a context to read them, and would go stale when they change, so
+// the Ingresses taking them are requeued by the IngressClass and parameters watches instead.
+func (r *LoxilbIngressReconciler) getIngressBackendServices(ingress *netv1.Ingress) []string {
+	// index what can be parsed; invalid annotations are reported by Reconcile
+	config, _ := pkg.ParseIngressConfig(ingress)
+	services := make([]string, 0)
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service != nil {
+				name := path.Backend.Service.Name
+				services = append(services, config.GetBackendNamespace(ingress.Namespace, name)+"/"+name)
+			}
+		}
+	}
+
+	if backend, isok := r.getMaintenanceBackend(&config, 0); isok {
+		services = append(services, ingress.Namespace+"/"+backend.Name)
+	}
+	if config.ActiveColor != "" {
+		for _, backend := range []*netv1.IngressServiceBackend{config.BlueBackend, config.GreenBackend} {
+			services = append(services, config.GetBackendNamespace(ingress.Namespace, backend.Name)+"/"+backend.Name)
+		}
+	}
+	return services
+}
+
+// findIngressesForBackend enqueues the Ingresses routing to the service behind a changed object
+// (the Service itself or its Endpoints), so endpoint changes, and backends created after
+// the Ingress, are programmed promptly.
+func (r *LoxilbIngressReconciler) findIngressesForBackend(ctx context.Context, obj client.Object) []reconcile.Request {
+	logger := log.FromContext(ctx)
+	service := obj.GetNamespace() + "/" + obj.GetName()
+
+	ingressList := &netv1.IngressList{}
+	if err := r.Client.List(ctx, ingressList,
+		client.MatchingFields{backendServiceIndexKey: service}); err != nil {
+		logger.Error(err, "failed to list ingresses", "service", client.ObjectKeyFromObject(obj))
+		return nil
+	}
+
+	return r.dirtyIngressRequests(ingressList.Items)
+}
+
+// findIngressesForNamespace enqueues every Ingress of a namespace whose labels changed,
+// so Ingresses are picked up as soon as their namespace matches the namespace selector.
+func (r *LoxilbIngressReconciler) findIngressesForNamespace(ctx context.Context, obj client.Object) []reconcile.Request {
+	ingressList := &netv1.IngressList{}
+	if err := r.Client.List(ctx, ingressList, client.InNamespace(obj.GetName())); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list ingresses", "namespace", obj.GetName())
+		return nil
+	}
+
+	return r.dirtyIngressRequests(ingressList.Items)
+}
+
+// backendDebounceMaxWait caps, in debounce periods, how long a continuous stream of backend
+// changes can hold the reconcile of an Ingress back.
+const backendDebounceMaxWait = 10
+
+// backendDebouncer enqueues a request once no new event for it came for the debounce period,
+// or at the latest backendDebounceMaxWait periods after the first event of the burst.
+type backendDebouncer struct {
+	mu      sync.Mutex
+	pending map[reconcile.Request]*debouncedRequest
+}
+
+type debouncedRequest struct {
+	timer *time.Timer
+	first time.Time
+}
+
+func (d *backendDebouncer) add(req reconcile.Request, q workqueue.RateLimitingInterface, debounce time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending == nil {
+		d.pending = make(map[reconcile.Request]*debouncedRequest)
+	}
+
+	if pending, isok := d.pending[req]; isok {
+		// a timer that already fired is about to enqueue the request anyway
+		if time.Since(pending.first) < backendDebounceMaxWait*debounce && pending.timer.Stop() {
+			pending.timer.Reset(debounce)
+		}
+		return
+	}
+
+	pending := &debouncedRequest{first: time.Now()}
+	pending.timer = time.AfterFunc(debounce, func() {
+		d.mu.Lock()
+		if d.pending[req] == pending {
+			delete(d.pending, req)
+		}
+		d.mu.Unlock()
+		q.Add(req)
+	})
+	d.pending[req] = pending
+}
+
+// enqueueDebounced is like handler.EnqueueRequestsFromMapFunc, but enqueues the requests once
+// the events for them settled for BackendDebounce, so that a burst of backend changes (e.g.
+// during a rollout) is programmed by one reconcile after it, bounded to
+// backendDebounceMaxWait periods.
+func (r *LoxilbIngressReconciler) enqueueDebounced(mapFn handler.MapFunc) handler.EventHandler {
+	if r.BackendDebounce <= 0 {
+		return handler.EnqueueRequestsFromMapFunc(mapFn)
+	}
+
+	enqueue := func(ctx context.Context, obj client.Object, q workqueue.RateLimitingInterface) {
+		for _, req := range mapFn(ctx, obj) {
+			r.debouncer.add(req, q, r.BackendDebounce)
+		}
+	}
+	return handler.Funcs{
+		CreateFunc: func(ctx context.Context, e event.CreateEvent, q workqueue.RateLimitingInterface) {
+			enqueue(ctx, e.Object, q)
+		},
+		UpdateFunc: func(ctx context.Context, e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+			enqueue(ctx, e.ObjectNew, q)
+		},
+		DeleteFunc: func(ctx context.Context, e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+			enqueue(ctx, e.Object, q)
+		},
+		GenericFunc: func(ctx context.Context, e event.GenericEvent, q workqueue.RateLimitingInterface) {
+			enqueue(ctx, e.Object, q)
+		},
+	}
+}
+
+// dirtyIngressRequests returns the requests of ingresses and marks them dirty, so that
+// Reconcile does not skip them as unchanged: a dependent object changed, not the Ingress.
+func (r *LoxilbIngressReconciler) dirtyIngressRequests(ingresses []netv1.Ingress) []reconcile.Request {
+	requests := ingressRequests(ingresses)
+	for _, req := range requests {
+		r.dirtyKeys.Store(req.NamespacedName, struct{}{})
+	}
+	return requests
+}
+
+func ingressRequests(ingresses []netv1.Ingress) []reconcile.Request {
+	requests := make([]reconcile.Request, 0, len(ingresses))
+	for _, ingress := range ingresses {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{
+				Namespace: ingress.Namespace,
+				Name:      ingress.Name,
+			},
+		})
+	}
+	return requests
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package managers
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// countingQueue counts the requests added to it.
+type countingQueue struct {
+	workqueue.RateLimitingInterface
+	adds atomic.Int32
+}
+
+func (q *countingQueue) Add(item interface{}) {
+	q.adds.Add(1)
+	q.RateLimitingInterface.Add(item)
+}
+
+func TestEnqueueDebounced(t *testing.T) {
+	tests := []struct {
+		name     string
+		debounce time.Duration
+		events   int
+		interval time.Duration
+		// wantAdds is the number of requests enqueued by the end of the burst, and wantSettled
+		// once it settled
+		wantAdds    int32
+		wantSettled int32
+	}{
+		{name: "disabled", events: 5, wantAdds: 5, wantSettled: 5},
+		{name: "burst", debounce: 100 * time.Millisecond, events: 5, interval: 5 * time.Millisecond, wantSettled: 1},
+		// the stream lasts about 1.5 times backendDebounceMaxWait periods
+		{name: "continuous stream", debounce: 20 * time.Millisecond, events: 150, interval: 2 * time.Millisecond, wantAdds: 1, wantSettled: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &LoxilbIngressReconciler{BackendDebounce: tt.debounce}
+			req := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "web"}}
+			h := r.enqueueDebounced(func(context.Context, client.Object) []reconcile.Request {
+				return []reconcile.Request{req}
+			})
+			q := &countingQueue{RateLimitingInterface: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())}
+			defer q.ShutDown()
+
+			obj := testEndpoints("web")
+			for i := 0; i < tt.events; i++ {
+				h.Update(context.Background(), event.UpdateEvent{ObjectOld: obj, ObjectNew: obj}, q)
+				time.Sleep(tt.interval)
+			}
+			if adds := q.adds.Load(); adds != tt.wantAdds {
+				t.Errorf("enqueued %d times during the burst, want %d", adds, tt.wantAdds)
+			}
+
+			time.Sleep(2 * tt.debounce)
+			if adds := q.adds.Load(); adds != tt.wantSettled {
+				t.Errorf("enqueued %d times once settled, want %d", adds, tt.wantSettled)
+			}
+		})
+	}
+}
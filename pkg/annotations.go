@@ -0,0 +1,698 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	loxiapi "github.com/loxilb-io/kube-loxilb/pkg/api"
+)
+
+const (
+	// EnabledAnnotation set to "true" opts an Ingress in when the controller runs with
+	// --require-opt-in.
+	EnabledAnnotation = "loxilb.io/enabled"
+	// SecurityAnnotation overrides the security of the loxilb rule derived from spec.tls.
+	// Allowed values are "none", "https" and "e2e".
+	SecurityAnnotation = "loxilb.io/security"
+	// MaintenanceBackendAnnotation names a service ("name" or "name:port") in the Ingress
+	// namespace that serves traffic while a backend has no endpoints.
+	MaintenanceBackendAnnotation = "loxilb.io/maintenance-backend"
+	// BackendNamespacesAnnotation maps backend services to the namespaces they live in,
+	// as "svc1=ns1,svc2=ns2". Services not listed are looked up in the Ingress namespace.
+	BackendNamespacesAnnotation = "loxilb.io/backend-namespaces"
+	// ExternalBackendServiceAnnotation enables reading the namespace of a backend service
+	// from the "service-<name>-namespace" annotation.
+	//
+	// Deprecated: use BackendNamespacesAnnotation. Run with --migrate-backend-annotations
+	// to rewrite existing Ingresses.
+	ExternalBackendServiceAnnotation = "external-backend-service"
+	// EpSelectAnnotation sets the endpoint selection algorithm of the Ingress rules.
+	// EpSelectAnnotation + "-<service>" overrides it for the rules of one backend service.
+	EpSelectAnnotation = "loxilb.io/epselect"
+	// PublishNotReadyAnnotation publishes not-ready endpoints of the backends too when "true".
+	// Backends whose Service sets publishNotReadyAddresses always publish them.
+	PublishNotReadyAnnotation = "loxilb.io/publish-not-ready"
+	// EndpointDiscoveryAnnotation selects how backend endpoints are discovered: "endpoints"
+	// (default) reads the Endpoints object, "dns" resolves the (headless) service DNS name.
+	EndpointDiscoveryAnnotation = "loxilb.io/endpoint-discovery"
+	// TargetContainerAnnotation + "-<service>" names the pod container whose port, named like
+	// the service's targetPort, endpoints of that backend service are programmed with. This
+	// picks the right port in pods where several containers declare the same port name.
+	TargetContainerAnnotation = "loxilb.io/target-container"
+	// EndpointModeAnnotation selects what the rules target: "pod" (default) programs the pod
+	// IPs of the backends, "cluster" programs their ClusterIP and lets kube-proxy balance,
+	// "loadbalancer" programs the external IP of backends of type LoadBalancer.
+	EndpointModeAnnotation = "loxilb.io/endpoint-mode"
+	// ExternalIPAnnotation sets the VIP the rules of the Ingress are programmed on, instead
+	// of the loxilb-ingress address. Changing it moves the rules to the new VIP.
+	ExternalIPAnnotation = "loxilb.io/external-ip"
+	// ForceL4Annotation set to "true" programs plain L4 fullnat rules instead of fullproxy
+	// rules: hosts and paths are ignored, and TLS passes through to the backends.
+	ForceL4Annotation = "loxilb.io/force-l4"
+	// NatModeAnnotation sets the loxilb mode of the L4 rules of ForceL4Annotation: "fullnat"
+	// (default), "onearm", "dnat" which keeps the client IP and needs the return traffic to be
+	// routed through loxilb, or "dsr" where the backends reply to clients directly.
+	NatModeAnnotation = "loxilb.io/nat-mode"
+	// L4ProtocolAnnotation sets the protocol of the rules: "tcp" (default), "udp" or "sctp".
+	// udp and sctp require ForceL4Annotation.
+	L4ProtocolAnnotation = "loxilb.io/l4-protocol"
+	// FrontendPortAnnotation sets the port the rules of the Ingress listen on, instead of 80,
+	// or 443 for TLS hosts. TLS is still terminated according to spec.tls and SecurityAnnotation.
+	FrontendPortAnnotation = "loxilb.io/frontend-port"
+	// IPFamilyAnnotation selects the loxilb-ingress addresses the rules are programmed on:
+	// "ipv4", "ipv6" or "dual" for both. It defaults to the family of the primary address,
+	// and is ignored when ExternalIPAnnotation is set.
+	IPFamilyAnnotation = "loxilb.io/ip-family"
+	// SkipStatusUpdateAnnotation set to "true" leaves the status of the Ingress alone, for
+	// setups where another actor owns it. Rules are still programmed.
+	SkipStatusUpdateAnnotation = "loxilb.io/skip-status-update"
+	// RuleTTLAnnotation is a duration after which the loxilb rules of the Ingress are deleted,
+	// counted from the Ingress creation. Meant for ephemeral (e.g. preview) environments.
+	RuleTTLAnnotation = "loxilb.io/rule-ttl"
+	// ResyncIntervalAnnotation reprograms the Ingress periodically at this interval, on top of
+	// the event-driven reconciles, for critical services that must converge quickly.
+	ResyncIntervalAnnotation = "loxilb.io/resync-interval"
+	// MissingBackendAnnotation sets what the paths of a deleted backend service serve:
+	// "keep" (default) leaves the rules as last programmed until the service is back,
+	// "maintenance" serves MaintenanceBackendAnnotation and "remove" drops the paths. With
+	// backends using named ports, "maintenance" needs a port in MaintenanceBackendAnnotation.
+	MissingBackendAnnotation = "loxilb.io/missing-backend"
+	// MissingBackendGraceAnnotation is how long the rules are kept as last programmed before
+	// MissingBackendAnnotation applies.
+	MissingBackendGraceAnnotation = "loxilb.io/missing-backend-grace"
+	// ActiveColorAnnotation ("blue" or "green") sends all the traffic of the paths routed to
+	// either the blue or the green backend to the backend of the active color.
+	ActiveColorAnnotation = "loxilb.io/active-color"
+	// BlueBackendAnnotation names the blue backend service ("name" or "name:port").
+	BlueBackendAnnotation = "loxilb.io/blue-backend"
+	// GreenBackendAnnotation names the green backend service ("name" or "name:port").
+	GreenBackendAnnotation = "loxilb.io/green-backend"
+)
+
+// MinResyncInterval is the shortest ResyncIntervalAnnotation accepted, to avoid hot loops.
+const MinResyncInterval = 500 * time.Millisecond
+
+// EndpointMode is what the rules of an Ingress target.
+type EndpointMode string
+
+const (
+	// EndpointModePod targets the pod IPs of the backend services.
+	EndpointModePod EndpointMode = "pod"
+	// EndpointModeCluster targets the ClusterIP of the backend services.
+	EndpointModeCluster EndpointMode = "cluster"
+	// EndpointModeLoadBalancer targets the external IP of LoadBalancer backend services.
+	EndpointModeLoadBalancer EndpointMode = "loadbalancer"
+)
+
+// IPFamily selects the address family of the rules of an Ingress.
+type IPFamily string
+
+const (
+	// IPFamilyPrimary programs the rules on the primary loxilb-ingress address only.
+	IPFamilyPrimary IPFamily = ""
+	// IPFamilyIPv4 programs the rules on the IPv4 loxilb-ingress address.
+	IPFamilyIPv4 IPFamily = "ipv4"
+	// IPFamilyIPv6 programs the rules on the IPv6 loxilb-ingress address.
+	IPFamilyIPv6 IPFamily = "ipv6"
+	// IPFamilyDual programs the rules on both the IPv4 and the IPv6 address.
+	IPFamilyDual IPFamily = "dual"
+)
+
+// MissingBackend is what the paths of a deleted backend service serve.
+type MissingBackend string
+
+const (
+	// MissingBackendKeep leaves the rules as last programmed.
+	MissingBackendKeep MissingBackend = "keep"
+	// MissingBackendMaintenance serves the maintenance backend.
+	MissingBackendMaintenance MissingBackend = "maintenance"
+	// MissingBackendRemove drops the paths of the deleted backend.
+	MissingBackendRemove MissingBackend = "remove"
+)
+
+// natModes maps NatModeAnnotation values to the loxilb mode.
+var natModes = map[string]loxiapi.LbMode{
+	"fullnat": loxiapi.LBModeFullNAT,
+	"onearm":  loxiapi.LBModeOneArm,
+	"dnat":    loxiapi.LBModeDefault,
+	"dsr":     loxiapi.LBModeDSR,
+}
+
+// securityModes maps SecurityAnnotation values to the loxilb security integer.
+var securityModes = map[string]int32{
+	"none":  0,
+	"https": 1,
+	"e2e":   2,
+}
+
+// epSelects maps EpSelectAnnotation values to loxilb endpoint selection algorithms.
+var epSelects = map[string]loxiapi.EpSelect{
+	"rr":       loxiapi.LbSelRr,
+	"hash":     loxiapi.LbSelHash,
+	"priority": loxiapi.LbSelPrio,
+	"persist":  loxiapi.LbSelRrPersist,
+	"lc":       loxiapi.LbSelLeastConnections,
+	"n2":       loxiapi.LbSelN2,
+	"n3":       loxiapi.LbSelN3,
+}
+
+// IngressConfig is the loxilb configuration of an Ingress, read from its annotations.
+type IngressConfig struct {
+	// Security overrides the security derived from spec.tls when not nil.
+	Security *int32
+	// EpSelect is the endpoint selection of services without a ServiceEpSelect entry.
+	EpSelect loxiapi.EpSelect
+	// ServiceEpSelect holds the endpoint selection of individual backend services.
+	ServiceEpSelect map[string]loxiapi.EpSelect
+	// BackendNamespaces maps backend services to the namespace they live in.
+	BackendNamespaces map[string]string
+	// PublishNotReady programs not-ready endpoints too.
+	PublishNotReady bool
+	// DNSDiscovery discovers endpoints by resolving the service DNS name.
+	DNSDiscovery bool
+	// MaintenanceBackend serves traffic while a backend has no endpoints. A zero port
+	// means the maintenance service listens on the port of the backend it stands in for.
+	MaintenanceBackend *netv1.IngressServiceBackend
+	// TargetContainers maps backend services to the container serving their targetPort.
+	TargetContainers map[string]string
+	// EndpointMode is what the rules target.
+	EndpointMode EndpointMode
+	// ExternalIP is the VIP of the rules, or empty for the loxilb-ingress address.
+	ExternalIP string
+	// IPFamily selects the loxilb-ingress addresses of the rules.
+	IPFamily IPFamily
+	// ForceL4 programs L4 rules, without host matching nor TLS termination.
+	ForceL4 bool
+	// NatMode is the loxilb mode of the ForceL4 rules.
+	NatMode loxiapi.LbMode
+	// SkipStatusUpdate leaves the Ingress status alone.
+	SkipStatusUpdate bool
+	// L4Protocol is the protocol of the rules.
+	L4Protocol string
+	// FrontendPort is the port of the rules, or zero for the 80/443 default.
+	FrontendPort uint16
+	// RuleTTL is how long the rules of the Ingress live after its creation. Zero means forever.
+	RuleTTL time.Duration
+	// ResyncInterval is how often the Ingress is reprogrammed. Zero only reacts to events.
+	ResyncInterval time.Duration
+	// MissingBackend is what the paths of a deleted backend service serve, once
+	// MissingBackendGrace has passed.
+	MissingBackend      MissingBackend
+	MissingBackendGrace time.Duration
+	// ActiveColor is "blue" or "green", or empty when blue/green routing is not used.
+	ActiveColor string
+	// BlueBackend and GreenBackend are the backends switched between by ActiveColor.
+	// A zero port means the backend listens on the port of the path it serves.
+	BlueBackend  *netv1.IngressServiceBackend
+	GreenBackend *netv1.IngressServiceBackend
+}
+
+// ParseIngressConfig reads and validates the loxilb annotations of ingress. All invalid
+// annotations are reported in the returned error; the returned config still holds the
+// values of every valid annotation.
+func ParseIngressConfig(ingress *netv1.Ingress) (IngressConfig, error) {
+	config := IngressConfig{
+		EpSelect:          loxiapi.LbSelRr,
+		ServiceEpSelect:   make(map[string]loxiapi.EpSelect),
+		BackendNamespaces: make(map[string]string),
+		TargetContainers:  make(map[string]string),
+		EndpointMode:      EndpointModePod,
+		L4Protocol:        "tcp",
+		NatMode:           loxiapi.LBModeFullNAT,
+		MissingBackend:    MissingBackendKeep,
+	}
+
+	keys := make([]string, 0, len(ingress.Annotations))
+	for key := range ingress.Annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	errs := make([]error, 0)
+	for _, key := range keys {
+		value := ingress.Annotations[key]
+
+		var err error
+		switch {
+		case key == SecurityAnnotation:
+			config.Security, err = parseSecurity(value)
+		case key == EpSelectAnnotation:
+			config.EpSelect, err = parseEpSelect(value)
+		case strings.HasPrefix(key, EpSelectAnnotation+"-"):
+			var sel loxiapi.EpSelect
+			if sel, err = parseEpSelect(value); err == nil {
+				config.ServiceEpSelect[strings.TrimPrefix(key, EpSelectAnnotation+"-")] = sel
+			}
+		case strings.HasPrefix(key, TargetContainerAnnotation+"-"):
+			if msgs := validation.IsDNS1123Label(value); len(msgs) > 0 {
+				err = errors.New(strings.Join(msgs, ", "))
+			} else {
+				config.TargetContainers[strings.TrimPrefix(key, TargetContainerAnnotation+"-")] = value
+			}
+		case key == BackendNamespacesAnnotation:
+			var backendNamespaces map[string]string
+			backendNamespaces, err = ParseBackendNamespaces(value)
+			for name, ns := range backendNamespaces {
+				config.BackendNamespaces[name] = ns
+			}
+		case key == PublishNotReadyAnnotation:
+			config.PublishNotReady, err = strconv.ParseBool(value)
+		case key == EndpointDiscoveryAnnotation:
+			config.DNSDiscovery, err = parseEndpointDiscovery(value)
+		case key == MaintenanceBackendAnnotation:
+			config.MaintenanceBackend, err = parseServiceBackend(value)
+		case key == EndpointModeAnnotation:
+			config.EndpointMode, err = parseEndpointMode(value)
+		case key == ExternalIPAnnotation:
+			config.ExternalIP, err = parseExternalIP(value)
+		case key == IPFamilyAnnotation:
+			config.IPFamily, err = parseIPFamily(value)
+		case key == ForceL4Annotation:
+			config.ForceL4, err = strconv.ParseBool(value)
+		case key == SkipStatusUpdateAnnotation:
+			config.SkipStatusUpdate, err = strconv.ParseBool(value)
+		case key == NatModeAnnotation:
+			config.NatMode, err = parseNatMode(value)
+		case key == L4ProtocolAnnotation:
+			config.L4Protocol, err = parseL4Protocol(value)
+		case key == FrontendPortAnnotation:
+			config.FrontendPort, err = parseFrontendPort(value)
+		case key == MissingBackendAnnotation:
+			config.MissingBackend, err = parseMissingBackend(value)
+		case key == MissingBackendGraceAnnotation:
+			config.MissingBackendGrace, err = parseMissingBackendGrace(value)
+		case key == RuleTTLAnnotation:
+			config.RuleTTL, err = parseRuleTTL(value)
+		case key == ResyncIntervalAnnotation:
+			config.ResyncInterval, err = parseResyncInterval(value)
+		case key == ActiveColorAnnotation:
+			config.ActiveColor, err = parseColor(value)
+		case key == BlueBackendAnnotation:
+			config.BlueBackend, err = parseServiceBackend(value)
+		case key == GreenBackendAnnotation:
+			config.GreenBackend, err = parseServiceBackend(value)
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s annotation value %q: %w", key, value, err))
+		}
+	}
+
+	if config.ActiveColor != "" && (config.BlueBackend == nil || config.GreenBackend == nil) {
+		errs = append(errs, fmt.Errorf("%s annotation requires both %s and %s",
+			ActiveColorAnnotation, BlueBackendAnnotation, GreenBackendAnnotation))
+		config.ActiveColor = ""
+	}
+
+	if config.MissingBackend == MissingBackendMaintenance && config.MaintenanceBackend == nil {
+		errs = append(errs, fmt.Errorf("%s annotation value %q requires %s",
+			MissingBackendAnnotation, MissingBackendMaintenance, MaintenanceBackendAnnotation))
+		config.MissingBackend = MissingBackendKeep
+	} else if config.MissingBackend == MissingBackendMaintenance && config.MaintenanceBackend.Port.Name == "" &&
+		config.MaintenanceBackend.Port.Number == 0 && hasNamedBackendPort(ingress, &config) {
+		// the port of a deleted service cannot be resolved from its name
+		errs = append(errs, fmt.Errorf("%s annotation value %q requires a port in %s when backends use named ports",
+			MissingBackendAnnotation, MissingBackendMaintenance, MaintenanceBackendAnnotation))
+		config.MissingBackend = MissingBackendKeep
+	}
+
+	if _, isok := ingress.Annotations[NatModeAnnotation]; isok && !config.ForceL4 {
+		errs = append(errs, fmt.Errorf("%s annotation requires %s", NatModeAnnotation, ForceL4Annotation))
+	}
+	// host matching and TLS termination of fullproxy rules only work over tcp
+	if config.L4Protocol != "tcp" && !config.ForceL4 {
+		errs = append(errs, fmt.Errorf("%s annotation value %q requires %s",
+			L4ProtocolAnnotation, config.L4Protocol, ForceL4Annotation))
+		config.L4Protocol = "tcp"
+	}
+
+	// the deprecated scheme only fills in services BackendNamespacesAnnotation leaves out
+	if _, isok := ingress.Annotations[ExternalBackendServiceAnnotation]; isok {
+		deprecated, err := deprecatedBackendNamespaces(ingress.Annotations)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for name, ns := range deprecated {
+			if _, exists := config.BackendNamespaces[name]; !exists {
+				config.BackendNamespaces[name] = ns
+			}
+		}
+	}
+
+	return config, errors.Join(errs...)
+}
+
+// GetEpSelect returns the endpoint selection of the rules of backend service name.
+func (c *IngressConfig) GetEpSelect(name string) loxiapi.EpSelect {
+	if sel, isok := c.ServiceEpSelect[name]; isok {
+		return sel
+	}
+	return c.EpSelect
+}
+
+// GetBackendNamespace returns the namespace of backend service name of an Ingress in namespace ns.
+func (c *IngressConfig) GetBackendNamespace(ns, name string) string {
+	if backendNamespace, isok := c.BackendNamespaces[name]; isok {
+		return backendNamespace
+	}
+	return ns
+}
+
+// GetActiveBackend returns the backend that serves a path routed to backend: with blue/green
+// routing, paths routed to the blue or the green service are served by the active color.
+func (c *IngressConfig) GetActiveBackend(backend *netv1.IngressServiceBackend) *netv1.IngressServiceBackend {
+	if c.ActiveColor == "" || (backend.Name != c.BlueBackend.Name && backend.Name != c.GreenBackend.Name) {
+		return backend
+	}
+
+	active := c.BlueBackend.DeepCopy()
+	if c.ActiveColor == "green" {
+		active = c.GreenBackend.DeepCopy()
+	}
+	if active.Port.Name == "" && active.Port.Number == 0 {
+		active.Port = backend.Port
+	}
+	return active
+}
+
+// FormatSecurity returns the SecurityAnnotation value of a loxilb security integer.
+func FormatSecurity(security int32) (string, bool) {
+	for value, mode := range securityModes {
+		if mode == security {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// FormatEpSelect returns the EpSelectAnnotation value of a loxilb endpoint selection.
+func FormatEpSelect(sel loxiapi.EpSelect) (string, bool) {
+	for value, epSelect := range epSelects {
+		if epSelect == sel {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func parseSecurity(value string) (*int32, error) {
+	security, isok := securityModes[value]
+	if !isok {
+		return nil, errors.New("must be one of none, https, e2e")
+	}
+	return &security, nil
+}
+
+func parseEpSelect(value string) (loxiapi.EpSelect, error) {
+	sel, isok := epSelects[value]
+	if !isok {
+		return loxiapi.LbSelRr, errors.New("must be one of rr, hash, priority, persist, lc, n2, n3")
+	}
+	return sel, nil
+}
+
+func parseEndpointDiscovery(value string) (bool, error) {
+	switch value {
+	case "endpoints":
+		return false, nil
+	case "dns":
+		return true, nil
+	}
+	return false, errors.New("must be one of endpoints, dns")
+}
+
+func parseEndpointMode(value string) (EndpointMode, error) {
+	switch mode := EndpointMode(value); mode {
+	case EndpointModePod, EndpointModeCluster, EndpointModeLoadBalancer:
+		return mode, nil
+	}
+	return EndpointModePod, errors.New("must be one of pod, cluster, loadbalancer")
+}
+
+func parseExternalIP(value string) (string, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", errors.New("must be an IP address")
+	}
+	return ip.String(), nil
+}
+
+func parseIPFamily(value string) (IPFamily, error) {
+	switch family := IPFamily(value); family {
+	case IPFamilyIPv4, IPFamilyIPv6, IPFamilyDual:
+		return family, nil
+	}
+	return IPFamilyPrimary, errors.New("must be one of ipv4, ipv6, dual")
+}
+
+func parseNatMode(value string) (loxiapi.LbMode, error) {
+	if mode, isok := natModes[value]; isok {
+		return mode, nil
+	}
+	return loxiapi.LBModeFullNAT, errors.New("must be one of fullnat, onearm, dnat, dsr")
+}
+
+func parseL4Protocol(value string) (string, error) {
+	switch value {
+	case "tcp", "udp", "sctp":
+		return value, nil
+	}
+	return "tcp", errors.New("must be one of tcp, udp, sctp")
+}
+
+func parseFrontendPort(value string) (uint16, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if errs := validation.IsValidPortNum(port); len(errs) > 0 {
+		return 0, errors.New(strings.Join(errs, ", "))
+	}
+	return uint16(port), nil
+}
+
+func parseMissingBackend(value string) (MissingBackend, error) {
+	switch mode := MissingBackend(value); mode {
+	case MissingBackendKeep, MissingBackendMaintenance, MissingBackendRemove:
+		return mode, nil
+	}
+	return MissingBackendKeep, errors.New("must be one of keep, maintenance, remove")
+}
+
+func parseMissingBackendGrace(value string) (time.Duration, error) {
+	grace, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if grace < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	return grace, nil
+}
+
+func parseRuleTTL(value string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, errors.New("must be a positive duration")
+	}
+	return ttl, nil
+}
+
+func parseResyncInterval(value string) (time.Duration, error) {
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if interval < MinResyncInterval {
+		return 0, fmt.Errorf("must be at least %s", MinResyncInterval)
+	}
+	return interval, nil
+}
+
+func parseColor(value string) (string, error) {
+	if value != "blue" && value != "green" {
+		return "", errors.New("must be one of blue, green")
+	}
+	return value, nil
+}
+
+// hasNamedBackendPort reports whether a backend of the Ingress rules, including blue/green
+// backends, refers to its service port by name.
+func hasNamedBackendPort(ingress *netv1.Ingress, config *IngressConfig) bool {
+	for _, backend := range []*netv1.IngressServiceBackend{config.BlueBackend, config.GreenBackend} {
+		if backend != nil && backend.Port.Name != "" {
+			return true
+		}
+	}
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service != nil && path.Backend.Service.Port.Name != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseServiceBackend parses a "name" or "name:port" service reference, where port is
+// either a port number or a port name.
+func parseServiceBackend(value string) (*netv1.IngressServiceBackend, error) {
+	name, portStr, hasPort := strings.Cut(value, ":")
+	if errs := validation.IsDNS1035Label(name); len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, ", "))
+	}
+
+	backend := &netv1.IngressServiceBackend{Name: name}
+	if !hasPort {
+		return backend, nil
+	}
+
+	if portNum, err := strconv.Atoi(portStr); err == nil {
+		if errs := validation.IsValidPortNum(portNum); len(errs) > 0 {
+			return nil, errors.New(strings.Join(errs, ", "))
+		}
+		backend.Port.Number = int32(portNum)
+	} else {
+		if errs := validation.IsValidPortName(portStr); len(errs) > 0 {
+			return nil, errors.New(strings.Join(errs, ", "))
+		}
+		backend.Port.Name = portStr
+	}
+	return backend, nil
+}
+
+// ParseBackendNamespaces parses a BackendNamespacesAnnotation value. Malformed entries are
+// reported in the error and left out of the returned map.
+func ParseBackendNamespaces(value string) (map[string]string, error) {
+	backendNamespaces := make(map[string]string)
+	errs := make([]error, 0)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, ns, err := parseBackendNamespace(entry)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		backendNamespaces[name] = ns
+	}
+	return backendNamespaces, errors.Join(errs...)
+}
+
+// parseBackendNamespace parses one "<service>=<namespace>" entry of BackendNamespacesAnnotation.
+func parseBackendNamespace(entry string) (string, string, error) {
+	name, ns, isok := strings.Cut(entry, "=")
+	if !isok || len(validation.IsDNS1035Label(name)) > 0 || len(validation.IsDNS1123Label(ns)) > 0 {
+		return "", "", fmt.Errorf("malformed entry %q, expected <service>=<namespace>", entry)
+	}
+	return name, ns, nil
+}
+
+// FormatBackendNamespaces is the inverse of ParseBackendNamespaces. Entries are sorted by
+// service name so that the same mapping always produces the same annotation value.
+func FormatBackendNamespaces(backendNamespaces map[string]string) string {
+	entries := make([]string, 0, len(backendNamespaces))
+	for name, ns := range backendNamespaces {
+		entries = append(entries, name+"="+ns)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// parseDeprecatedBackendKey returns the service name of a "service-<name>-namespace" key.
+func parseDeprecatedBackendKey(key string) (string, bool) {
+	name, hasPrefix := strings.CutPrefix(key, "service-")
+	name, hasSuffix := strings.CutSuffix(name, "-namespace")
+	return name, hasPrefix && hasSuffix && name != ""
+}
+
+// deprecatedBackendNamespaces returns the "service-<name>-namespace" annotations, validated
+// as the entries of BackendNamespacesAnnotation. Malformed ones are reported in the error
+// and left out of the returned map.
+func deprecatedBackendNamespaces(annotations map[string]string) (map[string]string, error) {
+	backendNamespaces := make(map[string]string)
+	errs := make([]error, 0)
+	for key, value := range annotations {
+		name, isok := parseDeprecatedBackendKey(key)
+		if !isok {
+			continue
+		}
+		name, ns, err := parseBackendNamespace(name + "=" + value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s annotation value %q: %w", key, value, err))
+			continue
+		}
+		backendNamespaces[name] = ns
+	}
+	return backendNamespaces, errors.Join(errs...)
+}
+
+// MigrateBackendAnnotations rewrites the deprecated ExternalBackendServiceAnnotation scheme
+// into BackendNamespacesAnnotation. It returns false when there is nothing to migrate.
+// Mappings already present in BackendNamespacesAnnotation win over the deprecated ones.
+// Annotations with malformed entries, deprecated or not, are not migrated and the entries
+// are reported in the error, so that no mapping is lost.
+func MigrateBackendAnnotations(annotations map[string]string) (map[string]string, bool, error) {
+	if _, isok := annotations[ExternalBackendServiceAnnotation]; !isok {
+		return annotations, false, nil
+	}
+
+	backendNamespaces, err := ParseBackendNamespaces(annotations[BackendNamespacesAnnotation])
+	deprecated, deprecatedErr := deprecatedBackendNamespaces(annotations)
+	if err = errors.Join(err, deprecatedErr); err != nil {
+		return annotations, false, err
+	}
+
+	migrated := make(map[string]string, len(annotations))
+	for key, value := range annotations {
+		if _, isok := parseDeprecatedBackendKey(key); isok {
+			continue
+		}
+		if key != ExternalBackendServiceAnnotation && key != BackendNamespacesAnnotation {
+			migrated[key] = value
+		}
+	}
+	for name, ns := range deprecated {
+		if _, exists := backendNamespaces[name]; !exists {
+			backendNamespaces[name] = ns
+		}
+	}
+
+	if len(backendNamespaces) > 0 {
+		migrated[BackendNamespacesAnnotation] = FormatBackendNamespaces(backendNamespaces)
+	}
+	return migrated, true, nil
+}
@@ -0,0 +1,546 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	loxiapi "github.com/loxilb-io/kube-loxilb/pkg/api"
+)
+
+// testIngress returns an Ingress routing / to service web, by port name when portName is set.
+func testIngress(annotations map[string]string, portName string) *netv1.Ingress {
+	port := netv1.ServiceBackendPort{Number: 80}
+	if portName != "" {
+		port = netv1.ServiceBackendPort{Name: portName}
+	}
+	return &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: annotations},
+		Spec: netv1.IngressSpec{
+			Rules: []netv1.IngressRule{{
+				Host: "a.example.com",
+				IngressRuleValue: netv1.IngressRuleValue{HTTP: &netv1.HTTPIngressRuleValue{
+					Paths: []netv1.HTTPIngressPath{{
+						Path:    "/",
+						Backend: netv1.IngressBackend{Service: &netv1.IngressServiceBackend{Name: "web", Port: port}},
+					}},
+				}},
+			}},
+		},
+	}
+}
+
+func TestParseIngressConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		portName    string
+		check       func(t *testing.T, config *IngressConfig)
+		// wantErrs are substrings of the error; none expects no error
+		wantErrs []string
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.Security != nil || config.EpSelect != loxiapi.LbSelRr || config.EndpointMode != EndpointModePod ||
+					config.L4Protocol != "tcp" || config.NatMode != loxiapi.LBModeFullNAT || config.MissingBackend != MissingBackendKeep {
+					t.Errorf("config = %+v, want the defaults", config)
+				}
+			},
+		},
+		{
+			name:        "security",
+			annotations: map[string]string{SecurityAnnotation: "e2e"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.Security == nil || *config.Security != 2 {
+					t.Errorf("security = %v, want 2", config.Security)
+				}
+			},
+		},
+		{
+			name:        "security none",
+			annotations: map[string]string{SecurityAnnotation: "none"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.Security == nil || *config.Security != 0 {
+					t.Errorf("security = %v, want 0", config.Security)
+				}
+			},
+		},
+		{
+			name:        "security https",
+			annotations: map[string]string{SecurityAnnotation: "https"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.Security == nil || *config.Security != 1 {
+					t.Errorf("security = %v, want 1", config.Security)
+				}
+			},
+		},
+		{
+			name:        "invalid security",
+			annotations: map[string]string{SecurityAnnotation: "tls"},
+			wantErrs:    []string{SecurityAnnotation},
+		},
+		{
+			name:        "epselect",
+			annotations: map[string]string{EpSelectAnnotation: "hash", EpSelectAnnotation + "-api": "lc"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if sel := config.GetEpSelect("web"); sel != loxiapi.LbSelHash {
+					t.Errorf("epselect of web = %v, want hash", sel)
+				}
+				if sel := config.GetEpSelect("api"); sel != loxiapi.LbSelLeastConnections {
+					t.Errorf("epselect of api = %v, want lc", sel)
+				}
+			},
+		},
+		{
+			name:        "invalid epselect",
+			annotations: map[string]string{EpSelectAnnotation + "-api": "random"},
+			wantErrs:    []string{EpSelectAnnotation + "-api"},
+		},
+		{
+			name:        "target container",
+			annotations: map[string]string{TargetContainerAnnotation + "-web": "app"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if container := config.TargetContainers["web"]; container != "app" {
+					t.Errorf("target container = %q, want app", container)
+				}
+			},
+		},
+		{
+			name:        "invalid target container",
+			annotations: map[string]string{TargetContainerAnnotation + "-web": "App_1"},
+			wantErrs:    []string{TargetContainerAnnotation + "-web"},
+		},
+		{
+			name:        "backend namespaces",
+			annotations: map[string]string{BackendNamespacesAnnotation: "web=backends, api=apis"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if ns := config.GetBackendNamespace("default", "web"); ns != "backends" {
+					t.Errorf("namespace of web = %q, want backends", ns)
+				}
+				if ns := config.GetBackendNamespace("default", "other"); ns != "default" {
+					t.Errorf("namespace of other = %q, want default", ns)
+				}
+			},
+		},
+		{
+			name:        "malformed backend namespaces",
+			annotations: map[string]string{BackendNamespacesAnnotation: "web=backends,api"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if ns := config.GetBackendNamespace("default", "web"); ns != "backends" {
+					t.Errorf("namespace of web = %q, want the valid entry kept", ns)
+				}
+			},
+			wantErrs: []string{`malformed entry "api"`},
+		},
+		{
+			name: "malformed deprecated backend namespace",
+			annotations: map[string]string{
+				ExternalBackendServiceAnnotation: "true",
+				"service-web-namespace":          "Not_A_Namespace",
+			},
+			check: func(t *testing.T, config *IngressConfig) {
+				if ns := config.GetBackendNamespace("default", "web"); ns != "default" {
+					t.Errorf("namespace of web = %q, want the malformed entry ignored", ns)
+				}
+			},
+			wantErrs: []string{"service-web-namespace", `malformed entry "web=Not_A_Namespace"`},
+		},
+		{
+			name: "deprecated backend namespaces",
+			annotations: map[string]string{
+				ExternalBackendServiceAnnotation: "true",
+				"service-web-namespace":          "old",
+				"service-api-namespace":          "apis",
+				BackendNamespacesAnnotation:      "web=backends",
+			},
+			check: func(t *testing.T, config *IngressConfig) {
+				if ns := config.GetBackendNamespace("default", "web"); ns != "backends" {
+					t.Errorf("namespace of web = %q, want %s to win", ns, BackendNamespacesAnnotation)
+				}
+				if ns := config.GetBackendNamespace("default", "api"); ns != "apis" {
+					t.Errorf("namespace of api = %q, want apis", ns)
+				}
+			},
+		},
+		{
+			name:        "publish not ready",
+			annotations: map[string]string{PublishNotReadyAnnotation: "true"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if !config.PublishNotReady {
+					t.Errorf("publish not ready = false, want true")
+				}
+			},
+		},
+		{
+			name:        "invalid publish not ready",
+			annotations: map[string]string{PublishNotReadyAnnotation: "yes"},
+			wantErrs:    []string{PublishNotReadyAnnotation},
+		},
+		{
+			name:        "endpoint discovery",
+			annotations: map[string]string{EndpointDiscoveryAnnotation: "dns"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if !config.DNSDiscovery {
+					t.Errorf("dns discovery = false, want true")
+				}
+			},
+		},
+		{
+			name:        "invalid endpoint discovery",
+			annotations: map[string]string{EndpointDiscoveryAnnotation: "consul"},
+			wantErrs:    []string{EndpointDiscoveryAnnotation},
+		},
+		{
+			name:        "maintenance backend",
+			annotations: map[string]string{MaintenanceBackendAnnotation: "sorry:http"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if backend := config.MaintenanceBackend; backend == nil || backend.Name != "sorry" || backend.Port.Name != "http" {
+					t.Errorf("maintenance backend = %+v, want sorry:http", backend)
+				}
+			},
+		},
+		{
+			name:        "invalid maintenance backend",
+			annotations: map[string]string{MaintenanceBackendAnnotation: "sorry:70000"},
+			wantErrs:    []string{MaintenanceBackendAnnotation},
+		},
+		{
+			name:        "endpoint mode",
+			annotations: map[string]string{EndpointModeAnnotation: "cluster"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.EndpointMode != EndpointModeCluster {
+					t.Errorf("endpoint mode = %q, want cluster", config.EndpointMode)
+				}
+			},
+		},
+		{
+			name:        "invalid endpoint mode",
+			annotations: map[string]string{EndpointModeAnnotation: "node"},
+			wantErrs:    []string{EndpointModeAnnotation},
+		},
+		{
+			name:        "external ip",
+			annotations: map[string]string{ExternalIPAnnotation: "2001:db8:0::1"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.ExternalIP != "2001:db8::1" {
+					t.Errorf("external ip = %q, want 2001:db8::1", config.ExternalIP)
+				}
+			},
+		},
+		{
+			name:        "invalid external ip",
+			annotations: map[string]string{ExternalIPAnnotation: "loxilb"},
+			wantErrs:    []string{ExternalIPAnnotation},
+		},
+		{
+			name:        "ip family",
+			annotations: map[string]string{IPFamilyAnnotation: "dual"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.IPFamily != IPFamilyDual {
+					t.Errorf("ip family = %q, want dual", config.IPFamily)
+				}
+			},
+		},
+		{
+			name:        "invalid ip family",
+			annotations: map[string]string{IPFamilyAnnotation: "ipv5"},
+			wantErrs:    []string{IPFamilyAnnotation},
+		},
+		{
+			name:        "skip status update",
+			annotations: map[string]string{SkipStatusUpdateAnnotation: "true"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if !config.SkipStatusUpdate {
+					t.Errorf("skip status update = false, want true")
+				}
+			},
+		},
+		{
+			name:        "force l4 with nat mode and protocol",
+			annotations: map[string]string{ForceL4Annotation: "true", NatModeAnnotation: "dsr", L4ProtocolAnnotation: "udp"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if !config.ForceL4 || config.NatMode != loxiapi.LBModeDSR || config.L4Protocol != "udp" {
+					t.Errorf("config = %+v, want force-l4 dsr over udp", config)
+				}
+			},
+		},
+		{
+			name:        "invalid nat mode",
+			annotations: map[string]string{ForceL4Annotation: "true", NatModeAnnotation: "snat"},
+			wantErrs:    []string{NatModeAnnotation},
+		},
+		{
+			name:        "nat mode without force l4",
+			annotations: map[string]string{NatModeAnnotation: "onearm"},
+			wantErrs:    []string{NatModeAnnotation + " annotation requires " + ForceL4Annotation},
+		},
+		{
+			name:        "l4 protocol without force l4",
+			annotations: map[string]string{L4ProtocolAnnotation: "sctp"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.L4Protocol != "tcp" {
+					t.Errorf("l4 protocol = %q, want the tcp fallback", config.L4Protocol)
+				}
+			},
+			wantErrs: []string{`value "sctp" requires ` + ForceL4Annotation},
+		},
+		{
+			name:        "invalid l4 protocol",
+			annotations: map[string]string{ForceL4Annotation: "true", L4ProtocolAnnotation: "icmp"},
+			wantErrs:    []string{L4ProtocolAnnotation},
+		},
+		{
+			name:        "frontend port",
+			annotations: map[string]string{FrontendPortAnnotation: "8443"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.FrontendPort != 8443 {
+					t.Errorf("frontend port = %d, want 8443", config.FrontendPort)
+				}
+			},
+		},
+		{
+			name:        "invalid frontend port",
+			annotations: map[string]string{FrontendPortAnnotation: "70000"},
+			wantErrs:    []string{FrontendPortAnnotation},
+		},
+		{
+			name:        "missing backend maintenance",
+			annotations: map[string]string{MissingBackendAnnotation: "maintenance", MaintenanceBackendAnnotation: "sorry", MissingBackendGraceAnnotation: "30s"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.MissingBackend != MissingBackendMaintenance || config.MissingBackendGrace != 30*time.Second {
+					t.Errorf("missing backend = %q after %s, want maintenance after 30s", config.MissingBackend, config.MissingBackendGrace)
+				}
+			},
+		},
+		{
+			name:        "missing backend maintenance without maintenance backend",
+			annotations: map[string]string{MissingBackendAnnotation: "maintenance"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.MissingBackend != MissingBackendKeep {
+					t.Errorf("missing backend = %q, want the keep fallback", config.MissingBackend)
+				}
+			},
+			wantErrs: []string{`value "maintenance" requires ` + MaintenanceBackendAnnotation},
+		},
+		{
+			name:        "missing backend maintenance for named ports",
+			annotations: map[string]string{MissingBackendAnnotation: "maintenance", MaintenanceBackendAnnotation: "sorry"},
+			portName:    "http",
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.MissingBackend != MissingBackendKeep {
+					t.Errorf("missing backend = %q, want the keep fallback", config.MissingBackend)
+				}
+			},
+			wantErrs: []string{"requires a port in " + MaintenanceBackendAnnotation},
+		},
+		{
+			name:        "missing backend maintenance with port for named ports",
+			annotations: map[string]string{MissingBackendAnnotation: "maintenance", MaintenanceBackendAnnotation: "sorry:8080"},
+			portName:    "http",
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.MissingBackend != MissingBackendMaintenance {
+					t.Errorf("missing backend = %q, want maintenance", config.MissingBackend)
+				}
+			},
+		},
+		{
+			name:        "invalid missing backend",
+			annotations: map[string]string{MissingBackendAnnotation: "drop", MissingBackendGraceAnnotation: "-1s"},
+			wantErrs:    []string{MissingBackendAnnotation, MissingBackendGraceAnnotation},
+		},
+		{
+			name:        "rule ttl and resync interval",
+			annotations: map[string]string{RuleTTLAnnotation: "1h", ResyncIntervalAnnotation: "10s"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.RuleTTL != time.Hour || config.ResyncInterval != 10*time.Second {
+					t.Errorf("rule ttl = %s, resync interval = %s, want 1h and 10s", config.RuleTTL, config.ResyncInterval)
+				}
+			},
+		},
+		{
+			name:        "invalid rule ttl and resync interval",
+			annotations: map[string]string{RuleTTLAnnotation: "0s", ResyncIntervalAnnotation: "100ms"},
+			wantErrs:    []string{RuleTTLAnnotation, ResyncIntervalAnnotation},
+		},
+		{
+			name:        "active color",
+			annotations: map[string]string{ActiveColorAnnotation: "green", BlueBackendAnnotation: "web-blue", GreenBackendAnnotation: "web-green:8080"},
+			check: func(t *testing.T, config *IngressConfig) {
+				backend := config.GetActiveBackend(&netv1.IngressServiceBackend{Name: "web-blue", Port: netv1.ServiceBackendPort{Number: 80}})
+				if backend.Name != "web-green" || backend.Port.Number != 8080 {
+					t.Errorf("active backend = %+v, want web-green:8080", backend)
+				}
+				other := &netv1.IngressServiceBackend{Name: "api"}
+				if backend := config.GetActiveBackend(other); backend != other {
+					t.Errorf("active backend of api = %+v, want api itself", backend)
+				}
+			},
+		},
+		{
+			name:        "active color without green backend",
+			annotations: map[string]string{ActiveColorAnnotation: "blue", BlueBackendAnnotation: "web-blue"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.ActiveColor != "" {
+					t.Errorf("active color = %q, want blue/green routing disabled", config.ActiveColor)
+				}
+			},
+			wantErrs: []string{ActiveColorAnnotation + " annotation requires both"},
+		},
+		{
+			name:        "invalid active color",
+			annotations: map[string]string{ActiveColorAnnotation: "red", BlueBackendAnnotation: "web-blue", GreenBackendAnnotation: "web-green"},
+			wantErrs:    []string{ActiveColorAnnotation},
+		},
+		{
+			name:        "errors are aggregated",
+			annotations: map[string]string{SecurityAnnotation: "tls", EndpointModeAnnotation: "node", FrontendPortAnnotation: "8080"},
+			check: func(t *testing.T, config *IngressConfig) {
+				if config.FrontendPort != 8080 {
+					t.Errorf("frontend port = %d, want the valid annotation applied", config.FrontendPort)
+				}
+			},
+			wantErrs: []string{SecurityAnnotation, EndpointModeAnnotation},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ParseIngressConfig(testIngress(tt.annotations, tt.portName))
+			if len(tt.wantErrs) == 0 && err != nil {
+				t.Errorf("error = %v, want none", err)
+			}
+			if len(tt.wantErrs) > 0 && err == nil {
+				t.Errorf("error = nil, want %q", tt.wantErrs)
+			}
+			for _, want := range tt.wantErrs {
+				if err != nil && !strings.Contains(err.Error(), want) {
+					t.Errorf("error = %v, want it to contain %q", err, want)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, &config)
+			}
+		})
+	}
+}
+
+func TestMigrateBackendAnnotations(t *testing.T) {
+	tests := []struct {
+		name         string
+		annotations  map[string]string
+		want         map[string]string
+		wantMigrated bool
+		wantErr      bool
+	}{
+		{
+			name:        "nothing to migrate",
+			annotations: map[string]string{BackendNamespacesAnnotation: "web=backends", "service-web-namespace": "old"},
+			want:        map[string]string{BackendNamespacesAnnotation: "web=backends", "service-web-namespace": "old"},
+		},
+		{
+			name: "deprecated scheme",
+			annotations: map[string]string{
+				ExternalBackendServiceAnnotation: "true",
+				"service-web-namespace":          "backends",
+				"service-api-namespace":          "apis",
+				EpSelectAnnotation:               "hash",
+			},
+			want: map[string]string{
+				BackendNamespacesAnnotation: "api=apis,web=backends",
+				EpSelectAnnotation:          "hash",
+			},
+			wantMigrated: true,
+		},
+		{
+			name: "backend namespaces win",
+			annotations: map[string]string{
+				ExternalBackendServiceAnnotation: "true",
+				"service-web-namespace":          "old",
+				"service-api-namespace":          "apis",
+				BackendNamespacesAnnotation:      "web=backends",
+			},
+			want:         map[string]string{BackendNamespacesAnnotation: "api=apis,web=backends"},
+			wantMigrated: true,
+		},
+		{
+			name:         "marker only",
+			annotations:  map[string]string{ExternalBackendServiceAnnotation: "true"},
+			want:         map[string]string{},
+			wantMigrated: true,
+		},
+		{
+			name: "malformed deprecated entry",
+			annotations: map[string]string{
+				ExternalBackendServiceAnnotation: "true",
+				"service-web-namespace":          "Not_A_Namespace",
+				"service-api-namespace":          "apis",
+			},
+			want: map[string]string{
+				ExternalBackendServiceAnnotation: "true",
+				"service-web-namespace":          "Not_A_Namespace",
+				"service-api-namespace":          "apis",
+			},
+			wantErr: true,
+		},
+		{
+			name: "malformed backend namespaces",
+			annotations: map[string]string{
+				ExternalBackendServiceAnnotation: "true",
+				"service-api-namespace":          "apis",
+				BackendNamespacesAnnotation:      "web",
+			},
+			want: map[string]string{
+				ExternalBackendServiceAnnotation: "true",
+				"service-api-namespace":          "apis",
+				BackendNamespacesAnnotation:      "web",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, migrated, err := MigrateBackendAnnotations(tt.annotations)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if migrated != tt.wantMigrated {
+				t.Errorf("migrated = %t, want %t", migrated, tt.wantMigrated)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("annotations = %v, want %v", got, tt.want)
+			}
+
+			// the migrated annotations configure the same backend namespaces
+			if !migrated {
+				return
+			}
+			before, _ := ParseIngressConfig(testIngress(tt.annotations, ""))
+			after, _ := ParseIngressConfig(testIngress(got, ""))
+			if fmt.Sprint(before.BackendNamespaces) != fmt.Sprint(after.BackendNamespaces) {
+				t.Errorf("backend namespaces = %v after migration, want %v", after.BackendNamespaces, before.BackendNamespaces)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pkg
+
+import (
+	"fmt"
+	"strings"
+)
+
+const nginxAnnotationPrefix = "nginx.ingress.kubernetes.io/"
+
+// nginxMapping translates the value of one nginx ingress annotation to a loxilb annotation.
+type nginxMapping struct {
+	nginxAnnotation string
+	annotation      string
+	values          map[string]string
+}
+
+// nginxMappings lists the nginx ingress annotations with a loxilb equivalent. Others, like
+// ssl-redirect or rewrite-target, have no counterpart in loxilb rules and are ignored. When
+// several map to the same loxilb annotation, the first one set wins: as in nginx,
+// upstream-hash-by takes precedence over load-balance.
+var nginxMappings = []nginxMapping{
+	{
+		nginxAnnotation: nginxAnnotationPrefix + "upstream-hash-by",
+		annotation:      EpSelectAnnotation,
+		// any hash key maps to loxilb's hash selection
+		values: nil,
+	},
+	{
+		nginxAnnotation: nginxAnnotationPrefix + "load-balance",
+		annotation:      EpSelectAnnotation,
+		values: map[string]string{
+			"round_robin": "rr",
+			"ewma":        "lc",
+			"least_conn":  "lc",
+		},
+	},
+	{
+		nginxAnnotation: nginxAnnotationPrefix + "backend-protocol",
+		annotation:      SecurityAnnotation,
+		values: map[string]string{
+			"HTTP":  "none",
+			"HTTPS": "e2e",
+		},
+	},
+}
+
+// MapNginxAnnotations returns annotations with the nginx ingress annotations translated to
+// their loxilb equivalents, along with a description of every mapping applied. loxilb
+// annotations that are already set are never overridden.
+func MapNginxAnnotations(annotations map[string]string) (map[string]string, []string) {
+	mapped := make(map[string]string, len(annotations))
+	for key, value := range annotations {
+		mapped[key] = value
+	}
+
+	applied := make([]string, 0)
+	for _, mapping := range nginxMappings {
+		value, isok := annotations[mapping.nginxAnnotation]
+		if !isok {
+			continue
+		}
+		if _, isSet := mapped[mapping.annotation]; isSet {
+			continue
+		}
+
+		loxiValue := "hash"
+		if mapping.values != nil {
+			if loxiValue, isok = mapping.values[strings.ToUpper(value)]; !isok {
+				if loxiValue, isok = mapping.values[strings.ToLower(value)]; !isok {
+					continue
+				}
+			}
+		}
+
+		mapped[mapping.annotation] = loxiValue
+		applied = append(applied, fmt.Sprintf("%s=%s -> %s=%s", mapping.nginxAnnotation, value, mapping.annotation, loxiValue))
+	}
+	return mapped, applied
+}
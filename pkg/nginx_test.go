@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2024 NetLOX Inc
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pkg
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMapNginxAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]string
+		wantApplied int
+	}{
+		{
+			name:        "load balance",
+			annotations: map[string]string{nginxAnnotationPrefix + "load-balance": "ewma"},
+			want:        map[string]string{nginxAnnotationPrefix + "load-balance": "ewma", EpSelectAnnotation: "lc"},
+			wantApplied: 1,
+		},
+		{
+			name:        "upstream hash by",
+			annotations: map[string]string{nginxAnnotationPrefix + "upstream-hash-by": "$remote_addr"},
+			want:        map[string]string{nginxAnnotationPrefix + "upstream-hash-by": "$remote_addr", EpSelectAnnotation: "hash"},
+			wantApplied: 1,
+		},
+		{
+			name: "upstream hash by wins over load balance",
+			annotations: map[string]string{
+				nginxAnnotationPrefix + "load-balance":     "round_robin",
+				nginxAnnotationPrefix + "upstream-hash-by": "$request_uri",
+			},
+			want: map[string]string{
+				nginxAnnotationPrefix + "load-balance":     "round_robin",
+				nginxAnnotationPrefix + "upstream-hash-by": "$request_uri",
+				EpSelectAnnotation:                         "hash",
+			},
+			wantApplied: 1,
+		},
+		{
+			name:        "backend protocol is case insensitive",
+			annotations: map[string]string{nginxAnnotationPrefix + "backend-protocol": "https"},
+			want:        map[string]string{nginxAnnotationPrefix + "backend-protocol": "https", SecurityAnnotation: "e2e"},
+			wantApplied: 1,
+		},
+		{
+			name:        "unknown value",
+			annotations: map[string]string{nginxAnnotationPrefix + "backend-protocol": "GRPC"},
+			want:        map[string]string{nginxAnnotationPrefix + "backend-protocol": "GRPC"},
+		},
+		{
+			name:        "unmapped annotation",
+			annotations: map[string]string{nginxAnnotationPrefix + "ssl-redirect": "true"},
+			want:        map[string]string{nginxAnnotationPrefix + "ssl-redirect": "true"},
+		},
+		{
+			name:        "loxilb annotation wins",
+			annotations: map[string]string{nginxAnnotationPrefix + "load-balance": "ewma", EpSelectAnnotation: "rr"},
+			want:        map[string]string{nginxAnnotationPrefix + "load-balance": "ewma", EpSelectAnnotation: "rr"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := fmt.Sprint(tt.annotations)
+			got, applied := MapNginxAnnotations(tt.annotations)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("annotations = %v, want %v", got, tt.want)
+			}
+			if len(applied) != tt.wantApplied {
+				t.Errorf("applied = %q, want %d mappings", applied, tt.wantApplied)
+			}
+			if fmt.Sprint(tt.annotations) != original {
+				t.Errorf("input annotations modified to %v", tt.annotations)
+			}
+		})
+	}
+}